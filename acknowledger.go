@@ -2,9 +2,13 @@ package amqp091otel
 
 import (
 	"context"
+	"slices"
+	"sync"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
-	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/rabbitmq/amqp091-go"
@@ -15,60 +19,272 @@ type acknowledger struct {
 	acker amqp091.Acknowledger // The real acknowledger is amqp091.Channel
 	ctx   context.Context      //nolint:containedctx // consumer needs to retrieve the context via ContextFromDelivery.
 	span  trace.Span
+	queue string
+	// key is the key of the acknowledger in Channel.spanMap,
+	// the tag of the delivery, or the greatest tag of the deliveries of a Batch.
+	key uint64
+	// start is when the delivery is received, used to measure the process duration.
+	start       time.Time
+	metricAttrs []attribute.KeyValue
+	// autoAck is whether the delivery is consumed with autoAck, such delivery is not in Channel.spanMap.
+	autoAck bool
+	// endOnce guards settling or abandoning the delivery, spanEndOnce guards ending the span.
+	// They differ only when settle spans are enabled, where the span may end before the delivery is settled.
+	endOnce     sync.Once
+	spanEndOnce sync.Once
+	// handlerErr is the error of the handler of ConsumeFunc, guarded by Channel.m.
+	// The span ends with it instead of the status of the settle outcome.
+	handlerErr error
+}
+
+// EndDelivery ends the span of a delivery when the consumer has done processing it.
+// If err is not nil, the span ends with an error status.
+//
+// It applies to deliveries consumed with autoAck when [AutoAckSpanEndManual] is used,
+// and to every delivery when [WithSettleSpans] is enabled.
+// Otherwise, it is a no-op, the span ends when the delivery is ack/nack/rejected.
+func EndDelivery(msg amqp091.Delivery, err error) {
+	if ack, ok := acknowledgerOf(msg); ok {
+		ack.endDelivery(err)
+	}
+}
+
+// acknowledgerOf returns the acknowledger of msg, which is shared by the deliveries of a Batch.
+func acknowledgerOf(msg amqp091.Delivery) (*acknowledger, bool) {
+	switch ack := msg.Acknowledger.(type) {
+	case *acknowledger:
+		return ack, true
+	case batchDeliveryAcknowledger:
+		return ack.batch, true
+	default:
+		return nil, false
+	}
+}
+
+// endDelivery ends the span when the consumer has done processing, see EndDelivery.
+func (a *acknowledger) endDelivery(err error) {
+	switch {
+	case a.autoAck:
+		a.endAutoAck(err)
+	case a.ch.cfg.SettleSpans:
+		a.endSpan(err)
+	}
 }
 
 func (a *acknowledger) Ack(tag uint64, multiple bool) error {
+	settleSpan := a.startSettleSpan("ack", tag)
 	err := a.acker.Ack(tag, multiple)
+	outcome := []attribute.KeyValue{settleOutcomeKey.String("ack")}
+	var settled []*acknowledger
 	if multiple {
-		a.endMultiple(tag, codes.Ok, "ack", err)
+		settled = a.endMultiple(tag, codes.Ok, "ack", outcome, err)
 	} else {
-		a.endOne(tag, codes.Ok, "ack", err)
+		settled = a.endOne(codes.Ok, "ack", outcome, err)
 	}
+	endSettleSpan(settleSpan, settled, err)
 	return err
 }
 
 func (a *acknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	settleSpan := a.startSettleSpan("nack", tag)
 	err := a.acker.Nack(tag, multiple, requeue)
+	outcome := []attribute.KeyValue{settleOutcomeKey.String("nack"), settleRequeueKey.Bool(requeue)}
+	var settled []*acknowledger
 	if multiple {
-		a.endMultiple(tag, codes.Error, "nack", err)
+		settled = a.endMultiple(tag, codes.Error, "nack", outcome, err)
 	} else {
-		a.endOne(tag, codes.Error, "nack", err)
+		settled = a.endOne(codes.Error, "nack", outcome, err)
 	}
+	endSettleSpan(settleSpan, settled, err)
 	return err
 }
 
 func (a *acknowledger) Reject(tag uint64, requeue bool) error {
+	settleSpan := a.startSettleSpan("reject", tag)
 	err := a.acker.Reject(tag, requeue)
-	a.endOne(tag, codes.Error, "reject", err)
+	outcome := []attribute.KeyValue{settleOutcomeKey.String("reject"), settleRequeueKey.Bool(requeue)}
+	settled := a.endOne(codes.Error, "reject", outcome, err)
+	endSettleSpan(settleSpan, settled, err)
 	return err
 }
 
-func (a *acknowledger) endMultiple(lastTag uint64, code codes.Code, desc string, err error) {
+func (a *acknowledger) endMultiple(
+	lastTag uint64, code codes.Code, desc string, outcome []attribute.KeyValue, err error,
+) []*acknowledger {
 	a.ch.m.Lock()
 	defer a.ch.m.Unlock()
 
-	for tag, span := range a.ch.spanMap {
-		span.SetAttributes(semconv.MessagingOperationName(desc))
+	var settled []*acknowledger
+	for tag, ack := range a.ch.spanMap {
 		if tag <= lastTag {
-			if err != nil {
-				span.RecordError(err)
-			}
-			span.SetStatus(code, desc)
-			span.End()
+			ack.end(code, desc, outcome, err)
 			delete(a.ch.spanMap, tag)
+			settled = append(settled, ack)
 		}
 	}
+	return settled
 }
 
-func (a *acknowledger) endOne(tag uint64, code codes.Code, desc string, err error) {
+func (a *acknowledger) endOne(code codes.Code, desc string, outcome []attribute.KeyValue, err error) []*acknowledger {
 	a.ch.m.Lock()
 	defer a.ch.m.Unlock()
 
-	a.span.SetAttributes(semconv.MessagingOperationName(desc))
+	a.end(code, desc, outcome, err)
+	delete(a.ch.spanMap, a.key)
+	return []*acknowledger{a}
+}
+
+// recordConsume counts the count deliveries of the acknowledger as consumed, once they are handed to the consumer.
+// Deliveries cancelled before that are never counted.
+func (a *acknowledger) recordConsume(count int64) {
+	a.ch.cfg.Metrics.recordConsume(a.ctx, count, a.metricAttrs)
+}
+
+// end ends the span of the delivery and records the process duration.
+func (a *acknowledger) end(code codes.Code, desc string, outcome []attribute.KeyValue, err error) {
+	a.endOnce.Do(func() {
+		if a.ch.cfg.SettleSpans {
+			// The settle operation is traced by its own span,
+			// so the span ends now only if the consumer hasn't ended it.
+			a.endSpan(a.handlerErr)
+		} else {
+			a.spanEndOnce.Do(func() {
+				a.setSettleOutcome(desc, outcome)
+				if err != nil {
+					a.span.RecordError(err)
+					a.span.SetAttributes(errorAttrs(err)...)
+				}
+				if a.handlerErr != nil {
+					a.span.RecordError(a.handlerErr)
+					a.span.SetStatus(codes.Error, a.handlerErr.Error())
+					a.span.SetAttributes(errorAttrs(a.handlerErr)...)
+				} else {
+					a.span.SetStatus(code, desc)
+				}
+				a.span.End()
+			})
+		}
+		a.ch.cfg.Metrics.recordProcess(a.ctx, a.start, slices.Concat(a.metricAttrs, outcome), err)
+	})
+}
+
+// setSettleOutcome records the outcome of settling the delivery on its span.
+// The v1.26.0 conventions name the operation after the outcome, i.e. ack, nack or reject,
+// while the current conventions keep it as process, so the outcome is recorded as attributes instead.
+func (a *acknowledger) setSettleOutcome(operationName string, outcome []attribute.KeyValue) {
+	if a.ch.cfg.SemconvStability.emitNew() {
+		a.span.SetAttributes(outcome...)
+		return
+	}
+	a.span.SetAttributes(semconv.MessagingOperationName(operationName))
+}
+
+// endSpan ends the span of the delivery, with an error status if err is not nil.
+func (a *acknowledger) endSpan(err error) {
+	a.spanEndOnce.Do(func() {
+		if err != nil {
+			a.span.RecordError(err)
+			a.span.SetStatus(codes.Error, err.Error())
+			a.span.SetAttributes(errorAttrs(err)...)
+		}
+		a.span.End()
+	})
+}
+
+// setHandlerErr sets the error of the handler of ConsumeFunc, which the span ends with once the delivery is settled.
+func (a *acknowledger) setHandlerErr(err error) {
+	a.ch.m.Lock()
+	defer a.ch.m.Unlock()
+
+	a.handlerErr = err
+}
+
+// abandon ends the span of the delivery that can no longer be settled because the channel is closed.
+func (a *acknowledger) abandon(err *amqp091.Error) {
+	a.endOnce.Do(func() {
+		a.endSpan(err)
+		a.ch.cfg.Metrics.recordProcess(a.ctx, a.start, slices.Clone(a.metricAttrs), err)
+	})
+}
+
+// cancel ends the span of the deliveries with tags that are never handed to the consumer because of err,
+// and requeues the deliveries unless they are consumed with autoAck, as no one else can settle them.
+func (a *acknowledger) cancel(err error, tags ...uint64) {
+	if !a.autoAck {
+		// Channel.m is taken before endOnce, in the same order as settling and abandoning, to avoid deadlocks.
+		a.ch.m.Lock()
+		for _, tag := range tags {
+			delete(a.ch.spanMap, tag)
+		}
+		a.ch.m.Unlock()
+	}
+	a.endOnce.Do(func() {
+		a.endSpan(err)
+		if !a.autoAck {
+			for _, tag := range tags {
+				// An error here means the channel is closed, where the broker requeues the delivery anyway.
+				_ = a.acker.Nack(tag, false, true)
+			}
+		}
+		a.ch.cfg.Metrics.recordProcess(a.ctx, a.start, slices.Clone(a.metricAttrs), err)
+	})
+}
+
+// endAutoAck ends the span of a delivery consumed with autoAck and records the process duration.
+// The broker considers such delivery acked once it is sent, so the outcome is always ack.
+func (a *acknowledger) endAutoAck(err error) {
+	a.endOnce.Do(func() {
+		outcome := []attribute.KeyValue{settleOutcomeKey.String("ack")}
+		a.spanEndOnce.Do(func() {
+			a.setSettleOutcome("ack", outcome)
+			if err != nil {
+				a.span.RecordError(err)
+				a.span.SetStatus(codes.Error, err.Error())
+				a.span.SetAttributes(errorAttrs(err)...)
+			} else {
+				a.span.SetStatus(codes.Ok, "ack")
+			}
+			a.span.End()
+		})
+		a.ch.cfg.Metrics.recordProcess(a.ctx, a.start, slices.Concat(a.metricAttrs, outcome), err)
+	})
+}
+
+// startSettleSpan starts a span of settling the delivery with tag, if settle spans are enabled,
+// otherwise it returns nil.
+func (a *acknowledger) startSettleSpan(operationName string, tag uint64) trace.Span {
+	if !a.ch.cfg.SettleSpans {
+		return nil
+	}
+	attrs := []attribute.KeyValue{
+		semconv.MessagingOperationTypeSettle,
+		semconv.MessagingOperationName(operationName),
+		semconv.MessagingDestinationAnonymous(queueAnonymous(a.queue)),
+		semconv.MessagingDestinationName(a.queue),
+		//nolint:gosec // overflow here is relatively safe and unlikely to happen
+		semconv.MessagingRabbitMQMessageDeliveryTag(int(tag)),
+	}
+	attrs = append(attrs, a.ch.commonAttrs()...)
+	opts := []trace.SpanStartOption{
+		trace.WithAttributes(attrs...),
+		trace.WithSpanKind(trace.SpanKindClient),
+	}
+	_, span := a.ch.cfg.Tracer.Start(a.ctx, a.ch.nameWhenSettle(a.queue, operationName), opts...)
+	return span
+}
+
+// endSettleSpan links the settle span to the spans of the settled deliveries and ends it.
+func endSettleSpan(span trace.Span, settled []*acknowledger, err error) {
+	if span == nil {
+		return
+	}
+	for _, ack := range settled {
+		span.AddLink(trace.LinkFromContext(ack.ctx))
+	}
 	if err != nil {
-		a.span.RecordError(err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(errorAttrs(err)...)
 	}
-	a.span.SetStatus(code, desc)
-	a.span.End()
-	delete(a.ch.spanMap, tag)
+	span.End()
 }
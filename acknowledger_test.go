@@ -6,14 +6,20 @@ import (
 	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	tracesdk "go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
 	"go.opentelemetry.io/otel/trace"
 
+	"github.com/rabbitmq/amqp091-go"
+
 	"github.com/wzy9607/amqp091otel/internal/mocks/amqp091"
 )
 
@@ -23,6 +29,11 @@ func initMockTracerProvider() (*tracesdk.TracerProvider, *tracetest.InMemoryExpo
 	return tp, exp
 }
 
+func newTestAcknowledger(ch *Channel, tp trace.TracerProvider, name string) *acknowledger {
+	ctx, span := tp.Tracer("test").Start(context.Background(), name)
+	return &acknowledger{ch: ch, ctx: ctx, span: span, start: time.Now()}
+}
+
 func Test_acknowledger(t *testing.T) {
 	t.Parallel()
 	type fields struct {
@@ -51,9 +62,9 @@ func Test_acknowledger(t *testing.T) {
 			setup: func(t *testing.T, fields *fields, args args) (exp *tracetest.InMemoryExporter) {
 				t.Helper()
 				tp, exp := initMockTracerProvider()
-				_, fields.ch.spanMap[args.tag] = tp.Tracer("test").Start(fields.ctx, "should end 1")
-				_, fields.ch.spanMap[args.tag+1] = tp.Tracer("test").Start(fields.ctx, "should not end")
-				fields.span = fields.ch.spanMap[args.tag]
+				fields.ch.spanMap[args.tag] = newTestAcknowledger(fields.ch, tp, "should end 1")
+				fields.ch.spanMap[args.tag+1] = newTestAcknowledger(fields.ch, tp, "should not end")
+				fields.span = fields.ch.spanMap[args.tag].span
 
 				fields.acker.EXPECT().Ack(args.tag, args.multiple).Return(nil)
 				return exp
@@ -69,10 +80,10 @@ func Test_acknowledger(t *testing.T) {
 			setup: func(t *testing.T, fields *fields, args args) (exp *tracetest.InMemoryExporter) {
 				t.Helper()
 				tp, exp := initMockTracerProvider()
-				_, fields.ch.spanMap[args.tag] = tp.Tracer("test").Start(fields.ctx, "should end 1")
-				_, fields.ch.spanMap[args.tag-1] = tp.Tracer("test").Start(fields.ctx, "should end 2")
-				_, fields.ch.spanMap[args.tag+1] = tp.Tracer("test").Start(fields.ctx, "should not end")
-				fields.span = fields.ch.spanMap[args.tag]
+				fields.ch.spanMap[args.tag] = newTestAcknowledger(fields.ch, tp, "should end 1")
+				fields.ch.spanMap[args.tag-1] = newTestAcknowledger(fields.ch, tp, "should end 2")
+				fields.ch.spanMap[args.tag+1] = newTestAcknowledger(fields.ch, tp, "should not end")
+				fields.span = fields.ch.spanMap[args.tag].span
 
 				fields.acker.EXPECT().Ack(args.tag, args.multiple).Return(nil)
 				return exp
@@ -89,9 +100,9 @@ func Test_acknowledger(t *testing.T) {
 			setup: func(t *testing.T, fields *fields, args args) (exp *tracetest.InMemoryExporter) {
 				t.Helper()
 				tp, exp := initMockTracerProvider()
-				_, fields.ch.spanMap[args.tag] = tp.Tracer("test").Start(fields.ctx, "should end 1")
-				_, fields.ch.spanMap[args.tag+1] = tp.Tracer("test").Start(fields.ctx, "should not end")
-				fields.span = fields.ch.spanMap[args.tag]
+				fields.ch.spanMap[args.tag] = newTestAcknowledger(fields.ch, tp, "should end 1")
+				fields.ch.spanMap[args.tag+1] = newTestAcknowledger(fields.ch, tp, "should not end")
+				fields.span = fields.ch.spanMap[args.tag].span
 
 				fields.acker.EXPECT().Nack(args.tag, args.multiple, args.requeue).Return(nil)
 				return exp
@@ -107,10 +118,10 @@ func Test_acknowledger(t *testing.T) {
 			setup: func(t *testing.T, fields *fields, args args) (exp *tracetest.InMemoryExporter) {
 				t.Helper()
 				tp, exp := initMockTracerProvider()
-				_, fields.ch.spanMap[args.tag] = tp.Tracer("test").Start(fields.ctx, "should end 1")
-				_, fields.ch.spanMap[args.tag-1] = tp.Tracer("test").Start(fields.ctx, "should end 2")
-				_, fields.ch.spanMap[args.tag+1] = tp.Tracer("test").Start(fields.ctx, "should not end")
-				fields.span = fields.ch.spanMap[args.tag]
+				fields.ch.spanMap[args.tag] = newTestAcknowledger(fields.ch, tp, "should end 1")
+				fields.ch.spanMap[args.tag-1] = newTestAcknowledger(fields.ch, tp, "should end 2")
+				fields.ch.spanMap[args.tag+1] = newTestAcknowledger(fields.ch, tp, "should not end")
+				fields.span = fields.ch.spanMap[args.tag].span
 
 				fields.acker.EXPECT().Nack(args.tag, args.multiple, args.requeue).Return(errors.New("some error"))
 				return exp
@@ -128,9 +139,9 @@ func Test_acknowledger(t *testing.T) {
 			setup: func(t *testing.T, fields *fields, args args) (exp *tracetest.InMemoryExporter) {
 				t.Helper()
 				tp, exp := initMockTracerProvider()
-				_, fields.ch.spanMap[args.tag] = tp.Tracer("test").Start(fields.ctx, "should end 1")
-				_, fields.ch.spanMap[args.tag+1] = tp.Tracer("test").Start(fields.ctx, "should not end")
-				fields.span = fields.ch.spanMap[args.tag]
+				fields.ch.spanMap[args.tag] = newTestAcknowledger(fields.ch, tp, "should end 1")
+				fields.ch.spanMap[args.tag+1] = newTestAcknowledger(fields.ch, tp, "should not end")
+				fields.span = fields.ch.spanMap[args.tag].span
 
 				fields.acker.EXPECT().Reject(args.tag, args.requeue).Return(errors.New("some error"))
 				return exp
@@ -149,7 +160,7 @@ func Test_acknowledger(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 			tt.fields = fields{
-				ch:    &Channel{spanMap: make(map[uint64]trace.Span)},
+				ch:    &Channel{cfg: newConfig(nil), spanMap: make(map[uint64]*acknowledger)},
 				acker: mockamqp091.NewMockAcknowledger(t),
 				ctx:   context.Background(),
 			}
@@ -159,6 +170,7 @@ func Test_acknowledger(t *testing.T) {
 				acker: tt.fields.acker,
 				ctx:   tt.fields.ctx,
 				span:  tt.fields.span,
+				key:   tt.args.tag,
 			}
 			var err error
 			switch {
@@ -198,3 +210,185 @@ func Test_acknowledger(t *testing.T) {
 		})
 	}
 }
+
+func Test_acknowledger_endOne_key(t *testing.T) {
+	t.Parallel()
+	tp, exp := initMockTracerProvider()
+	ch := newTestChannel(t, WithTracerProvider(tp))
+	acker := mockamqp091.NewMockAcknowledger(t)
+	acker.EXPECT().Reject(uint64(1), false).Return(nil)
+	ack := newTestAcknowledger(ch, tp, "should end")
+	ack.acker = acker
+	// Like a batch, the acknowledger is registered under a greater tag than the settled one.
+	ack.key = 3
+	ch.spanMap[ack.key] = ack
+
+	require.NoError(t, ack.Reject(1, false))
+
+	assert.Empty(t, ch.spanMap)
+	assert.Len(t, exp.GetSpans(), 1)
+}
+
+func Test_acknowledger_metrics(t *testing.T) {
+	t.Parallel()
+	tp, _ := initMockTracerProvider()
+	mp, reader := initMockMeterProvider()
+	ch := &Channel{
+		cfg:     newConfig([]Option{WithTracerProvider(tp), WithMeterProvider(mp)}),
+		spanMap: make(map[uint64]*acknowledger),
+	}
+	acker := mockamqp091.NewMockAcknowledger(t)
+	acker.EXPECT().Nack(uint64(2), true, true).Return(nil)
+	for tag := uint64(1); tag <= 2; tag++ {
+		ack := newTestAcknowledger(ch, tp, "should end")
+		ack.acker = acker
+		ack.metricAttrs = []attribute.KeyValue{semconv.MessagingDestinationName("queue")}
+		ch.spanMap[tag] = ack
+	}
+
+	require.NoError(t, ch.spanMap[2].Nack(2, true, true))
+
+	got := collectMetrics(t, reader)
+	require.Contains(t, got, processDurationName)
+	duration, ok := got[processDurationName].Data.(metricdata.Histogram[float64])
+	require.True(t, ok)
+	require.Len(t, duration.DataPoints, 1)
+	assert.Equal(t, uint64(2), duration.DataPoints[0].Count)
+	assert.Equal(t, attribute.NewSet(
+		semconv.MessagingDestinationName("queue"),
+		settleOutcomeKey.String("nack"),
+		settleRequeueKey.Bool(true),
+	), duration.DataPoints[0].Attributes)
+}
+
+func TestEndDelivery(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		autoAck bool
+		err     error
+	}
+	tests := []struct {
+		name           string
+		args           args
+		wantEnded      bool
+		wantSpanStatus tracesdk.Status
+	}{
+		{
+			name:           "autoAck",
+			args:           args{autoAck: true},
+			wantEnded:      true,
+			wantSpanStatus: tracesdk.Status{Code: codes.Ok, Description: ""},
+		}, {
+			name:           "autoAck, got error",
+			args:           args{autoAck: true, err: errors.New("some error")},
+			wantEnded:      true,
+			wantSpanStatus: tracesdk.Status{Code: codes.Error, Description: "some error"},
+		}, {
+			name: "not autoAck",
+			args: args{autoAck: false},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp, exp := initMockTracerProvider()
+			ch := &Channel{cfg: newConfig(nil), spanMap: make(map[uint64]*acknowledger)}
+			ack := newTestAcknowledger(ch, tp, "span")
+			ack.autoAck = tt.args.autoAck
+			msg := amqp091.Delivery{Acknowledger: ack}
+
+			EndDelivery(msg, tt.args.err)
+			EndDelivery(msg, tt.args.err)
+
+			spans := exp.GetSpans()
+			spans = slices.DeleteFunc(spans, func(s tracetest.SpanStub) bool { return s.EndTime.IsZero() })
+			if !tt.wantEnded {
+				assert.Empty(t, spans)
+				return
+			}
+			require.Len(t, spans, 1)
+			assert.Equal(t, tt.wantSpanStatus, spans[0].Status)
+		})
+	}
+}
+
+func Test_acknowledger_settleSpans(t *testing.T) {
+	t.Parallel()
+	tp, exp := initMockTracerProvider()
+	ch := &Channel{
+		cfg:     newConfig([]Option{WithTracerProvider(tp), WithSettleSpans(true)}),
+		spanMap: make(map[uint64]*acknowledger),
+	}
+	acker := mockamqp091.NewMockAcknowledger(t)
+	acker.EXPECT().Ack(uint64(2), true).Return(errors.New("some error"))
+	for tag := uint64(1); tag <= 2; tag++ {
+		ack := newTestAcknowledger(ch, tp, "process")
+		ack.acker = acker
+		ack.queue = "queue"
+		ch.spanMap[tag] = ack
+	}
+
+	EndDelivery(amqp091.Delivery{Acknowledger: ch.spanMap[1]}, nil)
+	require.Len(t, exp.GetSpans(), 1, "process span should end under user control")
+
+	require.Error(t, ch.spanMap[2].Ack(2, true))
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 3)
+	assert.Empty(t, ch.spanMap)
+	for _, span := range spans[:2] {
+		assert.Equal(t, "process", span.Name)
+		assert.Equal(t, codes.Unset, span.Status.Code, "settle error should not be recorded on process span")
+	}
+	settleSpan := spans[2]
+	assert.Equal(t, "ack queue", settleSpan.Name)
+	assert.Equal(t, trace.SpanKindClient, settleSpan.SpanKind)
+	assert.Equal(t, codes.Error, settleSpan.Status.Code)
+	assert.Len(t, settleSpan.Links, 2)
+}
+
+// onEndProcessor is a span processor that calls itself when a span ends.
+type onEndProcessor func(tracesdk.ReadOnlySpan)
+
+func (onEndProcessor) OnStart(context.Context, tracesdk.ReadWriteSpan) {}
+func (p onEndProcessor) OnEnd(s tracesdk.ReadOnlySpan)                 { p(s) }
+func (onEndProcessor) Shutdown(context.Context) error                  { return nil }
+func (onEndProcessor) ForceFlush(context.Context) error                { return nil }
+
+func Test_acknowledger_cancel_whileAbandoning(t *testing.T) {
+	t.Parallel()
+	var ch *Channel
+	abandoned := make(chan struct{})
+	// The channel is closed right when the span of the cancelled delivery ends.
+	tp := tracesdk.NewTracerProvider(tracesdk.WithSpanProcessor(onEndProcessor(func(tracesdk.ReadOnlySpan) {
+		go func() {
+			ch.abandonPending(amqp091.ErrClosed)
+			close(abandoned)
+		}()
+		select {
+		case <-abandoned:
+		case <-time.After(100 * time.Millisecond):
+		}
+	})))
+	ch = newTestChannel(t, WithTracerProvider(tp))
+	acker := mockamqp091.NewMockAcknowledger(t)
+	acker.EXPECT().Nack(uint64(1), false, true).Return(nil)
+	msg := amqp091.Delivery{Acknowledger: acker, DeliveryTag: 1}
+	ack := ch.startConsumerSpan(&msg, "queue", operationDeliver, false)
+
+	cancelled := make(chan struct{})
+	go func() {
+		ack.cancel(context.Canceled, msg.DeliveryTag)
+		close(cancelled)
+	}()
+
+	for _, done := range []chan struct{}{cancelled, abandoned} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "cancelling and abandoning the delivery deadlocked")
+		}
+	}
+	assert.Empty(t, ch.spanMap)
+}
@@ -0,0 +1,89 @@
+package amqp091otel
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// Attributes that are not defined by the semantic conventions.
+const (
+	// errorCodeKey is the attribute key of the AMQP reply code of an amqp091.Error.
+	errorCodeKey = attribute.Key("messaging.rabbitmq.error.code")
+	// errorExceptionKey is the attribute key of whether an amqp091.Error is a "channel" or "connection" exception.
+	errorExceptionKey = attribute.Key("messaging.rabbitmq.error.exception")
+	// errorRecoverableKey is the attribute key of whether an amqp091.Error can be recovered
+	// by retrying later or with different parameters.
+	errorRecoverableKey = attribute.Key("messaging.rabbitmq.error.recoverable")
+	// consumerTagKey is the attribute key of the consumer tag of a delivery.
+	consumerTagKey = attribute.Key("messaging.rabbitmq.consumer.tag")
+	// settleOutcomeKey is the attribute key of how a delivery is settled, one of "ack", "nack" and "reject".
+	settleOutcomeKey = attribute.Key("messaging.rabbitmq.settle.outcome")
+	// settleRequeueKey is the attribute key of whether a nacked or rejected delivery is requeued.
+	settleRequeueKey = attribute.Key("messaging.rabbitmq.settle.requeue")
+	// confirmAckedKey is the attribute key of whether a publishing is acked by the broker.
+	confirmAckedKey = attribute.Key("messaging.rabbitmq.confirm.acked")
+	// confirmDurationKey is the attribute key of how long the broker took to confirm a publishing, in seconds.
+	confirmDurationKey = attribute.Key("messaging.rabbitmq.confirm.duration")
+	// handlerWaitDurationKey is the attribute key of how long a delivery waited
+	// between being received and its handler starting, in seconds.
+	handlerWaitDurationKey = attribute.Key("messaging.rabbitmq.handler.wait_duration")
+	// returnReplyCodeKey is the attribute key of the reply code of a returned publishing.
+	returnReplyCodeKey = attribute.Key("messaging.rabbitmq.return.reply_code")
+	// returnReplyTextKey is the attribute key of the reply text of a returned publishing.
+	returnReplyTextKey = attribute.Key("messaging.rabbitmq.return.reply_text")
+	// topologySourceExchangeKey is the attribute key of the source exchange of a binding.
+	topologySourceExchangeKey = attribute.Key("messaging.rabbitmq.source.exchange")
+	// topologyExchangeTypeKey is the attribute key of the type of a declared exchange.
+	topologyExchangeTypeKey = attribute.Key("messaging.rabbitmq.exchange.type")
+	// topologyMessageCountKey is the attribute key of the number of messages purged or deleted with a queue.
+	topologyMessageCountKey = attribute.Key("messaging.rabbitmq.message_count")
+	// headerKeyPrefix is the prefix of attribute keys of the delivery headers set by WithHeaderAttributes.
+	headerKeyPrefix = attribute.Key("messaging.rabbitmq.header.")
+	// topologyArgumentKeyPrefix is the prefix of attribute keys of the optional arguments of topology operations.
+	topologyArgumentKeyPrefix = attribute.Key("messaging.rabbitmq.argument.")
+)
+
+// tableValueAttr converts a value of an amqp091.Table to an attribute with key.
+// Nested tables, arrays and byte slices are not worth recording, for which it returns false.
+func tableValueAttr(key attribute.Key, val any) (attribute.KeyValue, bool) {
+	switch v := val.(type) {
+	case string:
+		return key.String(v), true
+	case bool:
+		return key.Bool(v), true
+	case int:
+		return key.Int(v), true
+	case int16:
+		return key.Int64(int64(v)), true
+	case int32:
+		return key.Int64(int64(v)), true
+	case int64:
+		return key.Int64(v), true
+	case float32:
+		return key.Float64(float64(v)), true
+	case float64:
+		return key.Float64(v), true
+	default:
+		return attribute.KeyValue{}, false
+	}
+}
+
+// headerAttrs converts the headers with names to attributes, see WithHeaderAttributes.
+// Byte slices are recorded as text, see headerString.
+func headerAttrs(headers amqp091.Table, names []string) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(names))
+	for _, name := range names {
+		val, ok := headers[name]
+		if !ok {
+			continue
+		}
+		key := headerKeyPrefix + attribute.Key(name)
+		if _, isBytes := val.([]byte); isBytes {
+			attrs = append(attrs, key.String(headerString(val)))
+		} else if attr, ok := tableValueAttr(key, val); ok {
+			attrs = append(attrs, attr)
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,433 @@
+package amqp091otel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// Batch is a batch of deliveries that are processed together, traced by one span.
+// The span is linked to the span of the publishing of each delivery.
+//
+// The deliveries must be settled as a whole, by [Batch.Ack] or [Batch.Nack],
+// which ends the span, like settling a single delivery does.
+// Settling a delivery of the batch on its own returns [ErrBatchDelivery].
+type Batch struct {
+	Deliveries []amqp091.Delivery
+	ack        *acknowledger
+	// lastTag is the greatest delivery tag of the batch, used to settle the batch with multiple.
+	lastTag uint64
+}
+
+// ErrBatchDelivery is returned when a delivery of a [Batch] is settled on its own instead of by the batch.
+var ErrBatchDelivery = errors.New("amqp091otel: delivery of a batch must be settled by the batch")
+
+// batchDeliveryAcknowledger is the acknowledger of each delivery of a Batch.
+// It rejects settling the delivery on its own, which would end the span of the whole batch.
+type batchDeliveryAcknowledger struct {
+	batch *acknowledger
+}
+
+func (batchDeliveryAcknowledger) Ack(uint64, bool) error {
+	return ErrBatchDelivery
+}
+
+func (batchDeliveryAcknowledger) Nack(uint64, bool, bool) error {
+	return ErrBatchDelivery
+}
+
+func (batchDeliveryAcknowledger) Reject(uint64, bool) error {
+	return ErrBatchDelivery
+}
+
+// Context returns the context of the batch span, to trace processing the batch.
+func (b *Batch) Context() context.Context {
+	return b.ack.ctx
+}
+
+// Ack acknowledges every delivery of the batch, with a single multiple ack.
+// Like [amqp091.Delivery.Ack] with multiple, it also acknowledges unsettled deliveries
+// with smaller tags on the channel, which are not in the batch.
+func (b *Batch) Ack() error {
+	return b.ack.Ack(b.lastTag, true)
+}
+
+// Nack negatively acknowledges every delivery of the batch, with a single multiple nack.
+// Like [amqp091.Delivery.Nack] with multiple, it also negatively acknowledges unsettled deliveries
+// with smaller tags on the channel, which are not in the batch.
+func (b *Batch) Nack(requeue bool) error {
+	return b.ack.Nack(b.lastTag, true, requeue)
+}
+
+// End ends the span of the batch when the consumer has done processing it, see [EndDelivery].
+func (b *Batch) End(err error) {
+	b.ack.endDelivery(err)
+}
+
+// BatchOptions are the options of batching deliveries in [Channel.ConsumeBatch].
+type BatchOptions struct {
+	// Size is the maximum number of deliveries in a batch, 1 if it is not positive.
+	Size int
+	// MaxWait is how long to wait for a batch to be full since its first delivery is received,
+	// a batch that is not full is handed over after that. MaxWait <= 0 means waiting until the batch is full.
+	MaxWait time.Duration
+}
+
+// ConsumeBatch consumes deliveries from queue like [Channel.ConsumeWithContext], and hands them over in batches.
+// opts.SettlePolicy and opts.Workers are ignored.
+//
+// When ctx is done, the consumer is cancelled on the broker, and the returned channel is closed.
+// Batches that are never handed to the caller are cancelled like deliveries in [Channel.ConsumeWithContext].
+func (ch *Channel) ConsumeBatch(
+	ctx context.Context, queue string, opts ConsumeOptions, batchOpts BatchOptions,
+) (<-chan *Batch, error) {
+	deliveries, err := ch.Channel.ConsumeWithContext(ctx,
+		queue, opts.Consumer, opts.AutoAck, opts.Exclusive, opts.NoLocal, opts.NoWait, opts.Args)
+	if err != nil {
+		return nil, err
+	}
+	batches := make(chan *Batch)
+	go ch.forwardBatches(ctx, deliveries, batches, queue, opts.AutoAck, batchOpts)
+	return batches, nil
+}
+
+// forwardBatches collects deliveries into batches and forwards them to batches, until deliveries is closed.
+func (ch *Channel) forwardBatches(
+	ctx context.Context, deliveries <-chan amqp091.Delivery, batches chan<- *Batch,
+	queue string, autoAck bool, opts BatchOptions,
+) {
+	defer close(batches)
+	size := max(opts.Size, 1)
+	var (
+		msgs    []amqp091.Delivery
+		timer   *time.Timer
+		timeout <-chan time.Time
+	)
+	for {
+		flush := false
+		select {
+		case msg, ok := <-deliveries:
+			if !ok {
+				if len(msgs) > 0 {
+					ch.sendBatch(ctx, batches, ch.newBatch(msgs, queue, operationDeliver, autoAck))
+				}
+				return
+			}
+			msgs = append(msgs, msg)
+			if len(msgs) == 1 && opts.MaxWait > 0 {
+				timer = time.NewTimer(opts.MaxWait)
+				timeout = timer.C
+			}
+			flush = len(msgs) >= size
+		case <-timeout:
+			flush = true
+		}
+		if !flush {
+			continue
+		}
+		if timer != nil {
+			timer.Stop()
+			timer, timeout = nil, nil
+		}
+		if !ch.sendBatch(ctx, batches, ch.newBatch(msgs, queue, operationDeliver, autoAck)) {
+			ch.cancelRest(ctx.Err(), deliveries, queue, autoAck)
+			return
+		}
+		msgs = nil
+	}
+}
+
+// sendBatch hands batch over to batches, or cancels it and returns false if ctx is done first.
+func (ch *Channel) sendBatch(ctx context.Context, batches chan<- *Batch, batch *Batch) bool {
+	select {
+	case batches <- batch:
+		batch.ack.recordConsume(int64(len(batch.Deliveries)))
+		if batch.ack.autoAck && ch.cfg.AutoAckSpanEnd == AutoAckSpanEndOnHandoff {
+			batch.ack.endAutoAck(nil)
+		}
+		return true
+	case <-ctx.Done():
+		batch.cancel(ctx.Err())
+		return false
+	}
+}
+
+// cancelRest cancels the rest of deliveries as one batch, once deliveries is closed by the consumer cancellation.
+func (ch *Channel) cancelRest(err error, deliveries <-chan amqp091.Delivery, queue string, autoAck bool) {
+	var msgs []amqp091.Delivery
+	for msg := range deliveries {
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) > 0 {
+		ch.newBatch(msgs, queue, operationDeliver, autoAck).cancel(err)
+	}
+}
+
+// GetBatch gets up to size deliveries from queue with [amqp091.Channel.Get], and returns them as a batch.
+// It returns a nil batch if the queue is empty.
+// If getting a delivery fails, the deliveries got so far are returned as a batch along with the error.
+func (ch *Channel) GetBatch(queue string, autoAck bool, size int) (*Batch, error) {
+	var (
+		msgs []amqp091.Delivery
+		err  error
+	)
+	for range max(size, 1) {
+		var (
+			msg amqp091.Delivery
+			ok  bool
+		)
+		msg, ok, err = ch.Channel.Get(queue, autoAck)
+		if err != nil || !ok {
+			break
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) == 0 {
+		return nil, err
+	}
+	batch := ch.newBatch(msgs, queue, operationReceive, autoAck)
+	batch.ack.recordConsume(int64(len(msgs)))
+	if autoAck && ch.cfg.AutoAckSpanEnd == AutoAckSpanEndOnHandoff {
+		batch.ack.endAutoAck(nil)
+	}
+	return batch, err
+}
+
+// newBatch starts the span of the batch of msgs, which must not be empty.
+// Every delivery of the batch shares the acknowledger of the batch,
+// which is tracked by the greatest delivery tag unless consumed with autoAck.
+// The batch is counted as consumed by the caller once it is handed to the consumer.
+func (ch *Channel) newBatch(msgs []amqp091.Delivery, queue string, op operation, autoAck bool) *Batch {
+	links := make([]trace.Link, 0, len(msgs))
+	var lastTag uint64
+	for i := range msgs {
+		lastTag = max(lastTag, msgs[i].DeliveryTag)
+		if sc := trace.SpanContextFromContext(ch.extract(&msgs[i])); sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc, Attributes: nil})
+		}
+	}
+
+	attrs := []attribute.KeyValue{
+		ch.cfg.SemconvStability.operationType(op),
+		semconv.MessagingOperationName(ch.cfg.SemconvStability.operationName(op)),
+		semconv.MessagingDestinationAnonymous(queueAnonymous(queue)),
+		semconv.MessagingDestinationName(queue),
+		semconv.MessagingBatchMessageCount(len(msgs)),
+	}
+	if ch.clientID != "" {
+		attrs = append(attrs, semconv.MessagingClientID(ch.clientID))
+	}
+	if msgs[0].ConsumerTag != "" {
+		attrs = append(attrs, consumerTagKey.String(msgs[0].ConsumerTag))
+	}
+	attrs = append(attrs, ch.commonAttrs()...)
+	opts := []trace.SpanStartOption{
+		trace.WithAttributes(attrs...),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(links...),
+	}
+
+	start := time.Now()
+	ctx, span := ch.cfg.Tracer.Start(context.Background(), //nolint:spancheck // span ends when the batch is settled
+		ch.nameWhenConsume(queue, op), opts...)
+	metricAttrs := ch.consumeMetricAttrs(queue, op)
+	ack := &acknowledger{
+		ch:          ch,
+		acker:       msgs[0].Acknowledger, // The channel that delivered msgs.
+		ctx:         ctx,
+		span:        span,
+		queue:       queue,
+		key:         lastTag,
+		start:       start,
+		metricAttrs: metricAttrs,
+		autoAck:     autoAck,
+		endOnce:     sync.Once{},
+		spanEndOnce: sync.Once{},
+		handlerErr:  nil,
+	}
+	for i := range msgs {
+		msgs[i].Acknowledger = batchDeliveryAcknowledger{batch: ack}
+	}
+	if !autoAck {
+		ch.m.Lock()
+		ch.spanMap[lastTag] = ack
+		ch.m.Unlock()
+	}
+	return &Batch{Deliveries: msgs, ack: ack, lastTag: lastTag}
+}
+
+// cancel cancels the batch that is never handed to the consumer because of err, see acknowledger.cancel.
+func (b *Batch) cancel(err error) {
+	tags := make([]uint64, 0, len(b.Deliveries))
+	for i := range b.Deliveries {
+		tags = append(tags, b.Deliveries[i].DeliveryTag)
+	}
+	b.ack.cancel(err, tags...)
+}
+
+// ErrNacked is returned by [Channel.PublishBatch] when the broker nacks any publishing of the batch.
+var ErrNacked = errors.New("amqp091otel: publishing nacked by the broker")
+
+// PublishRequest is a publishing in a batch published by [Channel.PublishBatch].
+// See [amqp091.Channel.PublishWithContext] for the fields.
+type PublishRequest struct {
+	Exchange  string
+	Key       string
+	Mandatory bool
+	Immediate bool
+	Msg       amqp091.Publishing
+}
+
+// PublishBatch publishes reqs in order, traced by one span with messaging.batch.message_count.
+// It stops at the first publishing that fails, and returns the error.
+//
+// By default, the context of the batch span is injected into every publishing.
+// With [WithPublishBatchCreateSpans], each publishing gets its own create span instead,
+// whose context is injected into it and linked from the batch span.
+//
+// When the channel is in confirm mode, see [amqp091.Channel.Confirm], PublishBatch waits until
+// every publishing is confirmed, and returns [ErrNacked] if any of them is nacked,
+// or the error of ctx if it is done first.
+func (ch *Channel) PublishBatch(ctx context.Context, reqs []PublishRequest) error {
+	return ch.publishBatch(ctx, reqs, ch.Channel.PublishWithDeferredConfirmWithContext)
+}
+
+func (ch *Channel) publishBatch(ctx context.Context, reqs []PublishRequest, publish publishFunc) error {
+	if len(reqs) == 0 {
+		return nil
+	}
+	attrs := []attribute.KeyValue{
+		ch.cfg.SemconvStability.operationType(operationPublish),
+		semconv.MessagingOperationName(ch.cfg.SemconvStability.operationName(operationPublish)),
+		semconv.MessagingBatchMessageCount(len(reqs)),
+	}
+	name := ch.cfg.SemconvStability.operationName(operationPublish)
+	if exchange, ok := batchExchange(reqs); ok {
+		attrs = append(attrs,
+			semconv.MessagingDestinationAnonymous(exchange == ""),
+			semconv.MessagingDestinationName(exchange),
+		)
+		name = ch.nameWhenPublish(exchange)
+	}
+	if ch.clientID != "" {
+		attrs = append(attrs, semconv.MessagingClientID(ch.clientID))
+	}
+	attrs = append(attrs, ch.commonAttrs()...)
+	// The batch span is the producer span of the publishings, unless each of them has its own create span.
+	kind := trace.SpanKindProducer
+	if ch.cfg.PublishBatchCreateSpans {
+		kind = trace.SpanKindClient
+	}
+	opts := []trace.SpanStartOption{
+		trace.WithAttributes(attrs...),
+		trace.WithSpanKind(kind),
+	}
+	batchCtx, span := ch.cfg.Tracer.Start(ctx, name, opts...)
+	defer span.End()
+
+	var confirms []confirmation
+	for i := range reqs {
+		req := &reqs[i]
+		msg := req.Msg
+		msgCtx := batchCtx
+		if ch.cfg.PublishBatchCreateSpans {
+			msgCtx = ch.createSpan(ctx, req)
+			span.AddLink(trace.LinkFromContext(msgCtx))
+		}
+		setBaggageHeaders(ctx, &msg, ch.cfg.BaggageHeaders, ch.cfg.HeaderValueType)
+		ch.cfg.Propagators.Inject(msgCtx, newPublishingMessageCarrier(&msg, ch.cfg.HeaderValueType, ch.cfg.HeaderLayout))
+
+		start := time.Now()
+		dc, err := publish(batchCtx, req.Exchange, req.Key, req.Mandatory, req.Immediate, msg)
+		ch.cfg.Metrics.recordPublish(batchCtx, start, ch.publishMetricAttrs(req.Exchange), err)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			span.SetAttributes(errorAttrs(err)...)
+			return err
+		}
+		if dc != nil {
+			confirms = append(confirms, dc)
+		}
+	}
+	if len(confirms) == 0 {
+		return nil
+	}
+	return waitConfirms(ctx, span, confirms)
+}
+
+// batchExchange returns the exchange that every publishing of reqs is published to, if there is one.
+func batchExchange(reqs []PublishRequest) (string, bool) {
+	exchange := reqs[0].Exchange
+	for i := range reqs {
+		if reqs[i].Exchange != exchange {
+			return "", false
+		}
+	}
+	return exchange, true
+}
+
+// createSpan traces creating the publishing of req with a create span that ends immediately,
+// and returns the context of the span to be injected into the publishing.
+func (ch *Channel) createSpan(ctx context.Context, req *PublishRequest) context.Context {
+	attrs := []attribute.KeyValue{
+		ch.cfg.SemconvStability.operationType(operationCreate),
+		semconv.MessagingOperationName(ch.cfg.SemconvStability.operationName(operationCreate)),
+		semconv.MessagingDestinationAnonymous(req.Exchange == ""),
+		semconv.MessagingDestinationName(req.Exchange),
+		semconv.MessagingRabbitMQDestinationRoutingKey(req.Key),
+	}
+	if ch.clientID != "" {
+		attrs = append(attrs, semconv.MessagingClientID(ch.clientID))
+	}
+	if req.Msg.CorrelationId != "" {
+		attrs = append(attrs, semconv.MessagingMessageConversationID(req.Msg.CorrelationId))
+	}
+	if req.Msg.MessageId != "" {
+		attrs = append(attrs, semconv.MessagingMessageID(req.Msg.MessageId))
+	}
+	attrs = append(attrs, ch.commonAttrs()...)
+	opts := []trace.SpanStartOption{
+		trace.WithAttributes(attrs...),
+		trace.WithSpanKind(trace.SpanKindProducer),
+	}
+	ctx, span := ch.cfg.Tracer.Start(ctx, ch.nameWhenCreate(req.Exchange), opts...)
+	span.End()
+	return ctx
+}
+
+// waitConfirms waits until every publishing of the batch traced by span is confirmed, or ctx is done.
+func waitConfirms(ctx context.Context, span trace.Span, confirms []confirmation) error {
+	start := time.Now()
+	acked := true
+	for _, dc := range confirms {
+		select {
+		case <-dc.Done():
+			acked = acked && dc.Acked()
+		case <-ctx.Done():
+			err := ctx.Err()
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			span.SetAttributes(errorAttrs(err)...)
+			return err
+		}
+	}
+	span.SetAttributes(
+		confirmAckedKey.Bool(acked),
+		confirmDurationKey.Float64(time.Since(start).Seconds()),
+	)
+	if !acked {
+		span.SetStatus(codes.Error, "nack")
+		span.SetAttributes(semconv.ErrorTypeKey.String("nack"))
+		return ErrNacked
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package amqp091otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/rabbitmq/amqp091-go"
+
+	"github.com/wzy9607/amqp091otel/internal/mocks/amqp091"
+)
+
+func TestChannel_newBatch(t *testing.T) {
+	t.Parallel()
+	tp, exp := initMockTracerProvider()
+	ch := newTestChannel(t, WithTracerProvider(tp), WithPropagators(propagation.TraceContext{}))
+	acker := mockamqp091.NewMockAcknowledger(t)
+	acker.EXPECT().Ack(uint64(3), true).Return(nil)
+	msgs := make([]amqp091.Delivery, 0, 3)
+	for tag := uint64(1); tag <= 3; tag++ {
+		ctx, publishSpan := tp.Tracer("test").Start(context.Background(), "publish")
+		publishSpan.End()
+		msg := amqp091.Delivery{Acknowledger: acker, DeliveryTag: tag, Headers: amqp091.Table{}}
+		ch.cfg.Propagators.Inject(ctx, newDeliveryMessageCarrier(&msg, ch.cfg.HeaderLayout))
+		msgs = append(msgs, msg)
+	}
+
+	batch := ch.newBatch(msgs, "queue", operationReceive, false)
+	require.Len(t, ch.spanMap, 1)
+	for _, msg := range batch.Deliveries {
+		assert.Equal(t, batch.Context(), ContextFromDelivery(msg))
+		require.ErrorIs(t, msg.Ack(false), ErrBatchDelivery, "deliveries should be settled by the batch")
+	}
+	require.Len(t, ch.spanMap, 1)
+	require.NoError(t, batch.Ack())
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 4)
+	span := spans[3]
+	assert.False(t, span.Parent.IsValid())
+	assert.Contains(t, span.Attributes, semconv.MessagingBatchMessageCount(3))
+	require.Len(t, span.Links, 3)
+	for i, link := range span.Links {
+		assert.Equal(t, spans[i].SpanContext.SpanID(), link.SpanContext.SpanID())
+	}
+	assert.Equal(t, codes.Ok, span.Status.Code)
+	assert.Empty(t, ch.spanMap)
+}
+
+func TestChannel_forwardBatches(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		opts     BatchOptions
+		msgCount int
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantCounts []int
+	}{
+		{
+			name:       "full batches and the rest when deliveries is closed",
+			args:       args{opts: BatchOptions{Size: 2}, msgCount: 3},
+			wantCounts: []int{2, 1},
+		}, {
+			name:       "batch of one",
+			args:       args{opts: BatchOptions{}, msgCount: 2},
+			wantCounts: []int{1, 1},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			ch := newTestChannel(t)
+			deliveries := make(chan amqp091.Delivery, tt.args.msgCount)
+			for tag := range uint64(tt.args.msgCount) {
+				deliveries <- amqp091.Delivery{DeliveryTag: tag + 1}
+			}
+			close(deliveries)
+			batches := make(chan *Batch)
+			go ch.forwardBatches(context.Background(), deliveries, batches, "queue", true, tt.args.opts)
+
+			var counts []int
+			for batch := range batches {
+				counts = append(counts, len(batch.Deliveries))
+			}
+			assert.Equal(t, tt.wantCounts, counts)
+		})
+	}
+}
+
+func TestChannel_forwardBatches_maxWait(t *testing.T) {
+	t.Parallel()
+	ch := newTestChannel(t)
+	deliveries := make(chan amqp091.Delivery)
+	batches := make(chan *Batch)
+	go ch.forwardBatches(context.Background(), deliveries, batches, "queue", true,
+		BatchOptions{Size: 10, MaxWait: 10 * time.Millisecond})
+
+	deliveries <- amqp091.Delivery{DeliveryTag: 1}
+	batch := <-batches
+	assert.Len(t, batch.Deliveries, 1, "batch should be handed over after MaxWait")
+	close(deliveries)
+	_, ok := <-batches
+	assert.False(t, ok)
+}
+
+func TestChannel_forwardBatches_cancel(t *testing.T) {
+	t.Parallel()
+	tp, exp := initMockTracerProvider()
+	mp, reader := initMockMeterProvider()
+	ch := newTestChannel(t, WithTracerProvider(tp), WithMeterProvider(mp))
+	acker := mockamqp091.NewMockAcknowledger(t)
+	for tag := uint64(1); tag <= 3; tag++ {
+		acker.EXPECT().Nack(tag, false, true).Return(nil)
+	}
+	deliveries := make(chan amqp091.Delivery, 3)
+	for tag := uint64(1); tag <= 3; tag++ {
+		deliveries <- amqp091.Delivery{Acknowledger: acker, DeliveryTag: tag}
+	}
+	close(deliveries)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	batches := make(chan *Batch)
+
+	ch.forwardBatches(ctx, deliveries, batches, "queue", false, BatchOptions{Size: 2})
+
+	_, ok := <-batches
+	assert.False(t, ok)
+	assert.Empty(t, ch.spanMap)
+	assert.Zero(t, consumedMessages(t, reader), "cancelled batches should not be counted as consumed")
+	spans := exp.GetSpans()
+	require.Len(t, spans, 2)
+	for _, span := range spans {
+		assert.Equal(t, codes.Error, span.Status.Code)
+		assert.Equal(t, context.Canceled.Error(), span.Status.Description)
+	}
+}
+
+func TestChannel_publishBatch(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		opts []Option
+		reqs []PublishRequest
+	}
+	tests := []struct {
+		name          string
+		args          args
+		wantSpanCount int
+		wantName      string
+		wantLinks     int
+	}{
+		{
+			name:          "inject batch context",
+			args:          args{reqs: []PublishRequest{{Exchange: "exchange"}, {Exchange: "exchange"}}},
+			wantSpanCount: 1,
+			wantName:      "publish exchange",
+			wantLinks:     0,
+		}, {
+			name: "create spans",
+			args: args{
+				opts: []Option{WithPublishBatchCreateSpans(true)},
+				reqs: []PublishRequest{{Exchange: "exchange"}, {Exchange: "other"}},
+			},
+			wantSpanCount: 3,
+			wantName:      "publish",
+			wantLinks:     2,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp, exp := initMockTracerProvider()
+			opts := append([]Option{WithTracerProvider(tp), WithPropagators(propagation.TraceContext{})}, tt.args.opts...)
+			ch := newTestChannel(t, opts...)
+			var published []amqp091.Publishing
+			publish := func(
+				_ context.Context, _, _ string, _, _ bool, msg amqp091.Publishing,
+			) (*amqp091.DeferredConfirmation, error) {
+				published = append(published, msg)
+				return nil, nil
+			}
+
+			require.NoError(t, ch.publishBatch(context.Background(), tt.args.reqs, publish))
+
+			spans := exp.GetSpans()
+			require.Len(t, spans, tt.wantSpanCount)
+			batchSpan := spans[len(spans)-1]
+			assert.Equal(t, tt.wantName, batchSpan.Name)
+			assert.Contains(t, batchSpan.Attributes, semconv.MessagingBatchMessageCount(len(tt.args.reqs)))
+			assert.Len(t, batchSpan.Links, tt.wantLinks)
+			require.Len(t, published, len(tt.args.reqs))
+			for i, msg := range published {
+				carrier := newPublishingMessageCarrier(&msg, HeaderValueString, ch.cfg.HeaderLayout)
+				ctx := ch.cfg.Propagators.Extract(context.Background(), carrier)
+				sc := trace.SpanContextFromContext(ctx)
+				if tt.wantLinks == 0 {
+					assert.Equal(t, batchSpan.SpanContext.SpanID(), sc.SpanID())
+				} else {
+					assert.Equal(t, batchSpan.Links[i].SpanContext.SpanID(), sc.SpanID())
+				}
+			}
+		})
+	}
+}
+
+func TestChannel_publishBatch_error(t *testing.T) {
+	t.Parallel()
+	tp, exp := initMockTracerProvider()
+	ch := newTestChannel(t, WithTracerProvider(tp))
+	publishErr := errors.New("some error")
+	calls := 0
+	publish := func(
+		context.Context, string, string, bool, bool, amqp091.Publishing,
+	) (*amqp091.DeferredConfirmation, error) {
+		calls++
+		return nil, publishErr
+	}
+
+	err := ch.publishBatch(context.Background(), []PublishRequest{{}, {}}, publish)
+	require.ErrorIs(t, err, publishErr)
+	assert.Equal(t, 1, calls, "publishing should stop at the first error")
+	spans := exp.GetSpans()
+	require.Len(t, spans, 1)
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+}
+
+func Test_waitConfirms(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		acked  []bool
+		cancel bool
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantErr    error
+		wantStatus codes.Code
+	}{
+		{
+			name:       "all acked",
+			args:       args{acked: []bool{true, true}},
+			wantStatus: codes.Unset,
+		}, {
+			name:       "any nacked",
+			args:       args{acked: []bool{true, false}},
+			wantErr:    ErrNacked,
+			wantStatus: codes.Error,
+		}, {
+			name:       "ctx done",
+			args:       args{acked: []bool{true}, cancel: true},
+			wantErr:    context.Canceled,
+			wantStatus: codes.Error,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp, exp := initMockTracerProvider()
+			_, span := tp.Tracer("test").Start(context.Background(), "publish")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			confirms := make([]confirmation, 0, len(tt.args.acked))
+			for _, acked := range tt.args.acked {
+				done := make(chan struct{})
+				if !tt.args.cancel {
+					close(done)
+				}
+				confirms = append(confirms, &fakeConfirmation{done: done, acked: acked})
+			}
+			if tt.args.cancel {
+				cancel()
+			}
+
+			err := waitConfirms(ctx, span, confirms)
+			span.End()
+
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			spans := exp.GetSpans()
+			require.Len(t, spans, 1)
+			assert.Equal(t, tt.wantStatus, spans[0].Status.Code)
+		})
+	}
+}
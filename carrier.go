@@ -1,6 +1,11 @@
 package amqp091otel
 
 import (
+	"context"
+	"maps"
+	"strings"
+
+	"go.opentelemetry.io/otel/baggage"
 	"go.opentelemetry.io/otel/propagation"
 
 	"github.com/rabbitmq/amqp091-go"
@@ -9,84 +14,226 @@ import (
 var (
 	_ propagation.TextMapCarrier = (*publishingMessageCarrier)(nil)
 	_ propagation.TextMapCarrier = (*deliveryMessageCarrier)(nil)
+	_ propagation.TextMapCarrier = (*returnMessageCarrier)(nil)
 )
 
 // publishingMessageCarrier injects and extracts traces from a amqp091.Publishing.
 type publishingMessageCarrier struct {
 	msg *amqp091.Publishing
+	// valueType is the type of the header values set by Set.
+	valueType HeaderValueType
+	layout    headerLayout
+	// headersCloned is whether msg.Headers has been cloned by Set.
+	headersCloned bool
 }
 
 // newPublishingMessageCarrier creates a new publishingMessageCarrier.
-func newPublishingMessageCarrier(msg *amqp091.Publishing) publishingMessageCarrier {
-	return publishingMessageCarrier{msg: msg}
+// The headers table of msg is cloned before it is first written,
+// as it is usually shared with the caller even if msg is a copy.
+func newPublishingMessageCarrier(
+	msg *amqp091.Publishing, valueType HeaderValueType, layout headerLayout,
+) *publishingMessageCarrier {
+	return &publishingMessageCarrier{msg: msg, valueType: valueType, layout: layout, headersCloned: false}
 }
 
 // Get returns the value associated with the passed key.
-func (c publishingMessageCarrier) Get(key string) string {
-	valAny, ok := c.msg.Headers[key]
-	if !ok {
-		return ""
-	}
-	val, ok := valAny.(string)
-	if !ok {
-		return ""
-	}
-	return val
+func (c *publishingMessageCarrier) Get(key string) string {
+	return c.layout.get(c.msg.Headers, key)
 }
 
 // Set stores the key-value pair.
-func (c publishingMessageCarrier) Set(key, val string) {
-	if c.msg.Headers == nil {
-		c.msg.Headers = make(amqp091.Table)
+func (c *publishingMessageCarrier) Set(key, val string) {
+	if !c.headersCloned {
+		c.msg.Headers = c.layout.clone(c.msg.Headers)
+		c.headersCloned = true
 	}
-	c.msg.Headers[key] = val
+	c.layout.set(c.msg.Headers, key, headerValue(val, c.valueType))
 }
 
 // Keys lists the keys stored in this carrier.
-func (c publishingMessageCarrier) Keys() []string {
-	out := make([]string, 0, len(c.msg.Headers))
-	for key := range c.msg.Headers {
-		out = append(out, key)
-	}
-	return out
+func (c *publishingMessageCarrier) Keys() []string {
+	return c.layout.keys(c.msg.Headers)
 }
 
 // deliveryMessageCarrier injects and extracts traces from a amqp091.Delivery.
 type deliveryMessageCarrier struct {
-	msg *amqp091.Delivery
+	msg    *amqp091.Delivery
+	layout headerLayout
 }
 
 // newDeliveryMessageCarrier creates a new deliveryMessageCarrier.
-func newDeliveryMessageCarrier(msg *amqp091.Delivery) deliveryMessageCarrier {
-	return deliveryMessageCarrier{msg: msg}
+func newDeliveryMessageCarrier(msg *amqp091.Delivery, layout headerLayout) deliveryMessageCarrier {
+	return deliveryMessageCarrier{msg: msg, layout: layout}
 }
 
 // Get returns the value associated with the passed key.
 func (c deliveryMessageCarrier) Get(key string) string {
-	valAny, ok := c.msg.Headers[key]
-	if !ok {
-		return ""
-	}
-	val, ok := valAny.(string)
-	if !ok {
-		return ""
-	}
-	return val
+	return c.layout.get(c.msg.Headers, key)
 }
 
 // Set stores the key-value pair.
 func (c deliveryMessageCarrier) Set(key, val string) {
-	if c.msg.Headers == nil {
-		c.msg.Headers = make(amqp091.Table)
-	}
-	c.msg.Headers[key] = val
+	c.msg.Headers = c.layout.prepare(c.msg.Headers)
+	c.layout.set(c.msg.Headers, key, val)
 }
 
 // Keys lists the keys stored in this carrier.
 func (c deliveryMessageCarrier) Keys() []string {
-	out := make([]string, 0, len(c.msg.Headers))
-	for key := range c.msg.Headers {
+	return c.layout.keys(c.msg.Headers)
+}
+
+// returnMessageCarrier injects and extracts traces from a amqp091.Return.
+type returnMessageCarrier struct {
+	msg    *amqp091.Return
+	layout headerLayout
+}
+
+// newReturnMessageCarrier creates a new returnMessageCarrier.
+func newReturnMessageCarrier(msg *amqp091.Return, layout headerLayout) returnMessageCarrier {
+	return returnMessageCarrier{msg: msg, layout: layout}
+}
+
+// Get returns the value associated with the passed key.
+func (c returnMessageCarrier) Get(key string) string {
+	return c.layout.get(c.msg.Headers, key)
+}
+
+// Set stores the key-value pair.
+func (c returnMessageCarrier) Set(key, val string) {
+	c.msg.Headers = c.layout.prepare(c.msg.Headers)
+	c.layout.set(c.msg.Headers, key, val)
+}
+
+// Keys lists the keys stored in this carrier.
+func (c returnMessageCarrier) Keys() []string {
+	return c.layout.keys(c.msg.Headers)
+}
+
+// headerValue returns the header value of text val, of valueType.
+func headerValue(val string, valueType HeaderValueType) any {
+	if valueType == HeaderValueBytes {
+		return []byte(val)
+	}
+	return val
+}
+
+// setBaggageHeaders copies the baggage members in ctx with keys into the headers of msg, see WithBaggageHeaders.
+// Headers that msg already has are kept. The headers table of msg is cloned before it is first written.
+func setBaggageHeaders(ctx context.Context, msg *amqp091.Publishing, keys []string, valueType HeaderValueType) {
+	bag := baggage.FromContext(ctx)
+	cloned := false
+	for _, key := range keys {
+		member := bag.Member(key)
+		if member.Key() == "" {
+			continue
+		}
+		if _, ok := msg.Headers[key]; ok {
+			continue
+		}
+		if !cloned {
+			msg.Headers = maps.Clone(msg.Headers)
+			if msg.Headers == nil {
+				msg.Headers = make(amqp091.Table, len(keys))
+			}
+			cloned = true
+		}
+		msg.Headers[key] = headerValue(member.Value(), valueType)
+	}
+}
+
+// headerString returns the text of a header value.
+// Besides string, it accepts []byte, as clients in other languages often send text headers as byte arrays.
+func headerString(val any) string {
+	switch val := val.(type) {
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	default:
+		return ""
+	}
+}
+
+// headerLayout is where trace context is stored in the headers of a message,
+// see WithHeaderTable and WithHeaderPrefix. The zero value stores it in the top-level headers as is.
+type headerLayout struct {
+	// table is the name of the nested table that holds trace context, empty for the top-level headers.
+	table string
+	// prefix is prepended to the keys of trace context.
+	prefix string
+}
+
+func (l headerLayout) isDefault() bool {
+	return l.table == "" && l.prefix == ""
+}
+
+// scope returns the table of headers that holds trace context, nil if there is none.
+func (l headerLayout) scope(headers amqp091.Table) amqp091.Table {
+	if l.table == "" {
+		return headers
+	}
+	tbl, _ := headers[l.table].(amqp091.Table)
+	return tbl
+}
+
+// get returns the value of key in headers.
+// It falls back to the top-level headers, so messages injected with the default layout are still extracted.
+func (l headerLayout) get(headers amqp091.Table, key string) string {
+	if val, ok := l.scope(headers)[l.prefix+key]; ok {
+		return headerString(val)
+	}
+	return headerString(headers[key])
+}
+
+// set stores the key-value pair into headers, which must have been prepared.
+func (l headerLayout) set(headers amqp091.Table, key string, val any) {
+	l.scope(headers)[l.prefix+key] = val
+}
+
+// keys lists the keys in headers that get can look up.
+func (l headerLayout) keys(headers amqp091.Table) []string {
+	out := make([]string, 0, len(headers))
+	if l.isDefault() {
+		for key := range headers {
+			out = append(out, key)
+		}
+		return out
+	}
+	seen := make(map[string]struct{}, len(headers))
+	for key := range l.scope(headers) {
+		if key, ok := strings.CutPrefix(key, l.prefix); ok {
+			seen[key] = struct{}{}
+		}
+	}
+	for key := range headers {
+		if key != l.table {
+			seen[key] = struct{}{}
+		}
+	}
+	for key := range seen {
 		out = append(out, key)
 	}
 	return out
 }
+
+// prepare returns headers with the table that holds trace context, allocating them if missing.
+func (l headerLayout) prepare(headers amqp091.Table) amqp091.Table {
+	if headers == nil {
+		headers = make(amqp091.Table)
+	}
+	if l.table != "" && l.scope(headers) == nil {
+		headers[l.table] = make(amqp091.Table)
+	}
+	return headers
+}
+
+// clone returns a prepared copy of headers, which shares no table with headers.
+func (l headerLayout) clone(headers amqp091.Table) amqp091.Table {
+	headers = maps.Clone(headers)
+	if l.table != "" {
+		if tbl := l.scope(headers); tbl != nil {
+			headers[l.table] = maps.Clone(tbl)
+		}
+	}
+	return l.prepare(headers)
+}
@@ -1,9 +1,12 @@
 package amqp091otel
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/baggage"
 
 	"github.com/rabbitmq/amqp091-go"
 )
@@ -33,7 +36,12 @@ func Test_publishingMessageCarrier_Get(t *testing.T) {
 			args:   args{key: "foo"},
 			want:   "",
 		}, {
-			name:   "ignore not string",
+			name:   "decode bytes",
+			fields: fields{msg: &amqp091.Publishing{Headers: amqp091.Table{"foo": []byte("bar")}}},
+			args:   args{key: "foo"},
+			want:   "bar",
+		}, {
+			name:   "ignore not text",
 			fields: fields{msg: &amqp091.Publishing{Headers: amqp091.Table{"foo": 1}}},
 			args:   args{key: "foo"},
 			want:   "",
@@ -56,7 +64,7 @@ func Test_publishingMessageCarrier_Get(t *testing.T) {
 func Test_publishingMessageCarrier_Set(t *testing.T) {
 	t.Parallel()
 	msg := &amqp091.Publishing{}
-	carrier := newPublishingMessageCarrier(msg)
+	carrier := newPublishingMessageCarrier(msg, HeaderValueString, headerLayout{})
 
 	carrier.Set("foo", "bar")
 	carrier.Set("foo1", "bar1")
@@ -66,6 +74,30 @@ func Test_publishingMessageCarrier_Set(t *testing.T) {
 	assert.Equal(t, amqp091.Table{"foo": "bar", "foo1": "bar2", "foo2": "bar3"}, carrier.msg.Headers)
 }
 
+func Test_publishingMessageCarrier_Set_bytes(t *testing.T) {
+	t.Parallel()
+	msg := &amqp091.Publishing{}
+	carrier := newPublishingMessageCarrier(msg, HeaderValueBytes, headerLayout{})
+
+	carrier.Set("foo", "bar")
+
+	assert.Equal(t, amqp091.Table{"foo": []byte("bar")}, msg.Headers)
+	assert.Equal(t, "bar", carrier.Get("foo"))
+}
+
+func Test_publishingMessageCarrier_Set_copyOnWrite(t *testing.T) {
+	t.Parallel()
+	headers := amqp091.Table{"foo": "bar"}
+	msg := &amqp091.Publishing{Headers: headers}
+	carrier := newPublishingMessageCarrier(msg, HeaderValueString, headerLayout{})
+
+	carrier.Set("foo1", "bar1")
+	carrier.Set("foo2", "bar2")
+
+	assert.Equal(t, amqp091.Table{"foo": "bar"}, headers, "the original headers should not be modified")
+	assert.Equal(t, amqp091.Table{"foo": "bar", "foo1": "bar1", "foo2": "bar2"}, msg.Headers)
+}
+
 func Test_publishingMessageCarrier_Keys(t *testing.T) {
 	t.Parallel()
 	type fields struct {
@@ -128,7 +160,12 @@ func Test_deliveryMessageCarrier_Get(t *testing.T) {
 			args:   args{key: "foo"},
 			want:   "",
 		}, {
-			name:   "ignore not string",
+			name:   "decode bytes",
+			fields: fields{msg: &amqp091.Delivery{Headers: amqp091.Table{"foo": []byte("bar")}}},
+			args:   args{key: "foo"},
+			want:   "bar",
+		}, {
+			name:   "ignore not text",
 			fields: fields{msg: &amqp091.Delivery{Headers: amqp091.Table{"foo": 1}}},
 			args:   args{key: "foo"},
 			want:   "",
@@ -151,7 +188,7 @@ func Test_deliveryMessageCarrier_Get(t *testing.T) {
 func Test_deliveryMessageCarrier_Set(t *testing.T) {
 	t.Parallel()
 	msg := &amqp091.Delivery{}
-	carrier := newDeliveryMessageCarrier(msg)
+	carrier := newDeliveryMessageCarrier(msg, headerLayout{})
 
 	carrier.Set("foo", "bar")
 	carrier.Set("foo1", "bar1")
@@ -197,3 +234,142 @@ func Test_deliveryMessageCarrier_Keys(t *testing.T) {
 		})
 	}
 }
+
+func Test_returnMessageCarrier_Get(t *testing.T) {
+	t.Parallel()
+	type fields struct {
+		msg *amqp091.Return
+	}
+	type args struct {
+		key string
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		args   args
+		want   string
+	}{
+		{
+			name:   "exists",
+			fields: fields{msg: &amqp091.Return{Headers: amqp091.Table{"foo": "bar"}}},
+			args:   args{key: "foo"},
+			want:   "bar",
+		}, {
+			name:   "not exists",
+			fields: fields{msg: &amqp091.Return{Headers: amqp091.Table{"foo1": "bar"}}},
+			args:   args{key: "foo"},
+			want:   "",
+		}, {
+			name:   "decode bytes",
+			fields: fields{msg: &amqp091.Return{Headers: amqp091.Table{"foo": []byte("bar")}}},
+			args:   args{key: "foo"},
+			want:   "bar",
+		}, {
+			name:   "ignore not text",
+			fields: fields{msg: &amqp091.Return{Headers: amqp091.Table{"foo": 1}}},
+			args:   args{key: "foo"},
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			c := returnMessageCarrier{
+				msg: tt.fields.msg,
+			}
+			if got := c.Get(tt.args.key); got != tt.want {
+				t.Errorf("Get() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_returnMessageCarrier_Set(t *testing.T) {
+	t.Parallel()
+	msg := &amqp091.Return{}
+	carrier := newReturnMessageCarrier(msg, headerLayout{})
+
+	carrier.Set("foo", "bar")
+	carrier.Set("foo1", "bar1")
+	carrier.Set("foo1", "bar2")
+	carrier.Set("foo2", "bar3")
+
+	assert.Equal(t, amqp091.Table{"foo": "bar", "foo1": "bar2", "foo2": "bar3"}, carrier.msg.Headers)
+}
+
+func Test_headerLayout(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		layout headerLayout
+	}
+	tests := []struct {
+		name        string
+		args        args
+		wantHeaders amqp091.Table
+	}{
+		{
+			name:        "top-level",
+			args:        args{layout: headerLayout{}},
+			wantHeaders: amqp091.Table{"app": "1", "otel": amqp091.Table{"app": "2"}, "foo": "bar"},
+		}, {
+			name:        "nested table",
+			args:        args{layout: headerLayout{table: "otel"}},
+			wantHeaders: amqp091.Table{"app": "1", "otel": amqp091.Table{"app": "2", "foo": "bar"}},
+		}, {
+			name:        "prefix",
+			args:        args{layout: headerLayout{prefix: "otel-"}},
+			wantHeaders: amqp091.Table{"app": "1", "otel": amqp091.Table{"app": "2"}, "otel-foo": "bar"},
+		}, {
+			name:        "prefix in nested table",
+			args:        args{layout: headerLayout{table: "otel", prefix: "x-"}},
+			wantHeaders: amqp091.Table{"app": "1", "otel": amqp091.Table{"app": "2", "x-foo": "bar"}},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			nested := amqp091.Table{"app": "2"}
+			headers := amqp091.Table{"app": "1", "otel": nested}
+			msg := &amqp091.Publishing{Headers: headers}
+			carrier := newPublishingMessageCarrier(msg, HeaderValueString, tt.args.layout)
+
+			carrier.Set("foo", "bar")
+
+			assert.Equal(t, tt.wantHeaders, msg.Headers)
+			assert.Equal(t, amqp091.Table{"app": "2"}, nested, "the original nested table should not be modified")
+			assert.Equal(t, amqp091.Table{"app": "1", "otel": nested}, headers)
+			assert.Equal(t, "bar", carrier.Get("foo"))
+			assert.Contains(t, carrier.Keys(), "foo")
+		})
+	}
+}
+
+func Test_headerLayout_get_fallback(t *testing.T) {
+	t.Parallel()
+	layout := headerLayout{table: "otel", prefix: "x-"}
+	headers := amqp091.Table{"foo": "top-level", "bar": "top-level", "otel": amqp091.Table{"x-bar": "nested"}}
+
+	assert.Equal(t, "top-level", layout.get(headers, "foo"))
+	assert.Equal(t, "nested", layout.get(headers, "bar"))
+	assert.ElementsMatch(t, []string{"foo", "bar"}, layout.keys(headers))
+}
+
+func Test_setBaggageHeaders(t *testing.T) {
+	t.Parallel()
+	tenant, err := baggage.NewMember("tenant-id", "t1")
+	require.NoError(t, err)
+	source, err := baggage.NewMember("source", "web")
+	require.NoError(t, err)
+	bag, err := baggage.New(tenant, source)
+	require.NoError(t, err)
+	ctx := baggage.ContextWithBaggage(context.Background(), bag)
+	headers := amqp091.Table{"source": "app"}
+	msg := &amqp091.Publishing{Headers: headers}
+
+	setBaggageHeaders(ctx, msg, []string{"tenant-id", "source", "missing"}, HeaderValueString)
+
+	assert.Equal(t, amqp091.Table{"tenant-id": "t1", "source": "app"}, msg.Headers)
+	assert.Equal(t, amqp091.Table{"source": "app"}, headers, "the original headers should not be modified")
+}
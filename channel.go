@@ -4,10 +4,12 @@ import (
 	"context"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
-	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/rabbitmq/amqp091-go"
@@ -21,79 +23,213 @@ func queueAnonymous(queue string) bool {
 	return strings.HasPrefix(queue, "amq.gen-")
 }
 
-// Channel wraps an [amqp091.Channel] with OpenTelemetry tracing instrumentation.
+// Channel wraps an [amqp091.Channel] with OpenTelemetry tracing and metrics instrumentation.
 type Channel struct {
 	*amqp091.Channel
 	uri amqp091.URI
-	cfg *config
+	// conn is the connection that the channel belongs to, nil if unknown.
+	conn *amqp091.Connection
+	cfg  *config
+	// clientID is the messaging.client.id, see WithClientID.
+	clientID string
 	// When ack multiple, we need to end spans of every delivery before the tag,
-	// so we keep a map of every span that haven't ended.
-	spanMap map[uint64]trace.Span
+	// so we keep a map of the acknowledger of every span that haven't ended.
+	spanMap map[uint64]*acknowledger
 	m       sync.Mutex
+	// prefetchCount is the prefetch count last set by Qos, see WithDeliveryBufferSize.
+	prefetchCount atomic.Int64
 }
 
 // NewChannel returns an [amqp091.Channel] with OpenTelemetry tracing instrumentation.
+// url must be the AMQP URI of the connection that amqpChan belongs to,
+// consider using [Connection.Channel] instead, which also reports the address of the connected broker node.
 func NewChannel(amqpChan *amqp091.Channel, url string, opts ...Option) (*Channel, error) {
-	uri, err := amqp091.ParseURI(url)
+	uri, err := parseURI(url)
 	if err != nil {
 		return nil, err
 	}
+	return newChannel(amqpChan, nil, uri, newConfig(opts)), nil
+}
+
+func newChannel(amqpChan *amqp091.Channel, conn *amqp091.Connection, uri amqp091.URI, cfg *config) *Channel {
+	ch := &Channel{
+		Channel:       amqpChan,
+		uri:           uri,
+		conn:          conn,
+		cfg:           cfg,
+		clientID:      clientID(cfg, conn),
+		spanMap:       map[uint64]*acknowledger{},
+		m:             sync.Mutex{},
+		prefetchCount: atomic.Int64{},
+	}
+	go ch.watchClose(amqpChan.NotifyClose(make(chan *amqp091.Error, 1)))
+	return ch
+}
+
+// clientID returns the client ID set by WithClientID,
+// or the connection_name client property of conn if it is not set.
+func clientID(cfg *config, conn *amqp091.Connection) string {
+	if cfg.ClientID != "" || conn == nil {
+		return cfg.ClientID
+	}
+	if name, ok := conn.Config.Properties["connection_name"].(string); ok {
+		return name
+	}
+	return ""
+}
+
+// watchClose abandons every pending delivery when the channel is closed, either by the broker or gracefully.
+func (ch *Channel) watchClose(closes <-chan *amqp091.Error) {
+	for err := range closes {
+		ch.abandonPending(err)
+	}
+	ch.abandonPending(amqp091.ErrClosed)
+}
+
+// abandonPending ends the spans of every delivery that haven't been settled with err,
+// as they can no longer be settled on this channel.
+func (ch *Channel) abandonPending(err *amqp091.Error) {
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	for tag, ack := range ch.spanMap {
+		ack.abandon(err)
+		delete(ch.spanMap, tag)
+	}
+}
+
+// Close closes the channel and abandons every delivery that haven't been settled.
+// See [amqp091.Channel.Close] for details.
+func (ch *Channel) Close() error {
+	err := ch.Channel.Close()
+	ch.abandonPending(amqp091.ErrClosed)
+	return err
+}
+
+// parseURI parses the AMQP URI and strips the password, so it never ends up in telemetry.
+func parseURI(url string) (amqp091.URI, error) {
+	uri, err := amqp091.ParseURI(url)
+	if err != nil {
+		return uri, err
+	}
 	uri.Password = ""
-	cfg := newConfig(opts)
-	return &Channel{
-		Channel: amqpChan,
-		uri:     uri,
-		cfg:     cfg,
-		spanMap: map[uint64]trace.Span{},
-		m:       sync.Mutex{},
-	}, nil
+	return uri, nil
 }
 
 // https://opentelemetry.io/docs/specs/semconv/messaging/messaging-spans/#messaging-attributes
 // https://opentelemetry.io/docs/specs/semconv/messaging/rabbitmq/#rabbitmq-attributes
 func (ch *Channel) commonAttrs() []attribute.KeyValue {
-	return []attribute.KeyValue{
+	attrs := []attribute.KeyValue{
 		semconv.ServiceName(amqpLibName),
 		semconv.ServiceVersion(amqpLibVersion),
-		semconv.MessagingSystemRabbitmq,
+		semconv.MessagingSystemRabbitMQ,
 		semconv.NetworkProtocolName(ch.uri.Scheme),
 		semconv.NetworkProtocolVersion(netProtocolVer),
 		semconv.NetworkTransportTCP,
 		semconv.ServerAddress(ch.uri.Host),
 		semconv.ServerPort(ch.uri.Port),
-		// todo network.peer.address, network.peer.port
 	}
+	if ch.conn != nil {
+		attrs = append(attrs, netAttrs(ch.conn.RemoteAddr(), ch.conn.LocalAddr())...)
+	}
+	return attrs
 }
 
-func (*Channel) nameWhenPublish(exchange string) string {
+// https://opentelemetry.io/docs/specs/semconv/messaging/messaging-metrics/
+func (ch *Channel) publishMetricAttrs(exchange string) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		ch.cfg.SemconvStability.operationType(operationPublish),
+		semconv.MessagingOperationName(ch.cfg.SemconvStability.operationName(operationPublish)),
+		semconv.MessagingDestinationName(exchange),
+	}
+	return append(attrs, ch.commonAttrs()...)
+}
+
+func (ch *Channel) consumeMetricAttrs(queue string, op operation) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		ch.cfg.SemconvStability.operationType(op),
+		semconv.MessagingOperationName(ch.cfg.SemconvStability.operationName(op)),
+		semconv.MessagingDestinationName(queue),
+	}
+	return append(attrs, ch.commonAttrs()...)
+}
+
+func (ch *Channel) nameWhenPublish(exchange string) string {
+	if exchange == "" {
+		exchange = "(default)"
+	}
+	return ch.cfg.SemconvStability.operationName(operationPublish) + " " + exchange
+}
+
+func (ch *Channel) nameWhenCreate(exchange string) string {
 	if exchange == "" {
 		exchange = "(default)"
 	}
-	return "publish " + exchange
+	return ch.cfg.SemconvStability.operationName(operationCreate) + " " + exchange
+}
+
+func (ch *Channel) nameWhenConsume(queue string, op operation) string {
+	if queueAnonymous(queue) {
+		queue = "(anonymous)"
+	}
+	return ch.cfg.SemconvStability.operationName(op) + " " + queue
 }
 
-func (*Channel) nameWhenConsume(queue string) string {
+func (*Channel) nameWhenSettle(queue, operationName string) string {
 	if queueAnonymous(queue) {
 		queue = "(anonymous)"
 	}
-	return "process " + queue
+	return operationName + " " + queue
+}
+
+// extract returns the context extracted from msg by the propagators,
+// or by the first extractor that yields a valid span context if the propagators don't, see WithExtractors.
+func (ch *Channel) extract(msg *amqp091.Delivery) context.Context {
+	ctx := ch.cfg.Propagators.Extract(context.Background(), newDeliveryMessageCarrier(msg, ch.cfg.HeaderLayout))
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	for _, extractor := range ch.cfg.Extractors {
+		if sc := extractor(*msg); sc.IsValid() {
+			// Keep the baggage extracted by the propagators.
+			return trace.ContextWithRemoteSpanContext(ctx, sc)
+		}
+	}
+	return ctx
+}
+
+// startConsumerSpan starts the span of msg, which is handed to the consumer right away,
+// and counts it as consumed.
+func (ch *Channel) startConsumerSpan(
+	msg *amqp091.Delivery, queue string, op operation, autoAck bool,
+) *acknowledger {
+	ack := ch.startDeliverySpan(msg, queue, op, autoAck)
+	ack.recordConsume(1)
+	return ack
 }
 
-func (ch *Channel) startConsumerSpan(msg *amqp091.Delivery, queue string, operation attribute.KeyValue) {
+// startDeliverySpan starts the span of msg without counting it as consumed,
+// as it may be cancelled before it is handed to the consumer, see acknowledger.recordConsume.
+func (ch *Channel) startDeliverySpan(
+	msg *amqp091.Delivery, queue string, op operation, autoAck bool,
+) *acknowledger {
 	// Extract a span context from message
-	carrier := newDeliveryMessageCarrier(msg)
-	parentCtx := ch.cfg.Propagators.Extract(context.Background(), carrier)
+	parentCtx := ch.extract(msg)
 
 	// Create a span
 	attrs := []attribute.KeyValue{
-		operation,
-		semconv.MessagingOperationName("process"),
+		ch.cfg.SemconvStability.operationType(op),
+		semconv.MessagingOperationName(ch.cfg.SemconvStability.operationName(op)),
 		semconv.MessagingDestinationAnonymous(queueAnonymous(queue)),
 		semconv.MessagingDestinationName(queue),
-		semconv.MessagingDestinationPublishAnonymous(msg.Exchange == ""),
-		semconv.MessagingDestinationPublishName(msg.Exchange),
-		// todo messaging.client.id
-		semconv.MessagingRabbitmqDestinationRoutingKey(msg.RoutingKey),
+		semconv.MessagingRabbitMQDestinationRoutingKey(msg.RoutingKey),
+	}
+	attrs = append(attrs, ch.cfg.SemconvStability.publishDestinationAttrs(msg.Exchange)...)
+	if ch.clientID != "" {
+		attrs = append(attrs, semconv.MessagingClientID(ch.clientID))
+	}
+	if msg.ConsumerTag != "" {
+		attrs = append(attrs, consumerTagKey.String(msg.ConsumerTag))
 	}
 	if msg.MessageCount != 0 {
 		attrs = append(attrs, semconv.MessagingBatchMessageCount(int(msg.MessageCount)))
@@ -106,26 +242,44 @@ func (ch *Channel) startConsumerSpan(msg *amqp091.Delivery, queue string, operat
 	}
 	if msg.DeliveryTag != 0 {
 		//nolint:gosec // overflow here is relatively safe and unlikely to happen
-		attrs = append(attrs, semconv.MessagingRabbitmqMessageDeliveryTag(int(msg.DeliveryTag)))
+		attrs = append(attrs, semconv.MessagingRabbitMQMessageDeliveryTag(int(msg.DeliveryTag)))
 	}
+	attrs = append(attrs, headerAttrs(msg.Headers, ch.cfg.HeaderAttributes)...)
 	attrs = append(attrs, ch.commonAttrs()...)
 	opts := []trace.SpanStartOption{
 		trace.WithAttributes(attrs...),
 		trace.WithSpanKind(trace.SpanKindConsumer),
 	}
+	opts = append(opts, ch.cfg.ConsumerSpanRelationship.startOptions(parentCtx)...)
 
+	start := time.Now()
 	ctx, span := ch.cfg.Tracer.Start(parentCtx, //nolint:spancheck // span ends when msg is ack/nack/rejected
-		ch.nameWhenConsume(queue), opts...)
-	msg.Acknowledger = &acknowledger{
-		ch:    ch,
-		acker: ch.Channel,
-		ctx:   ctx,
-		span:  span,
+		ch.nameWhenConsume(queue, op), opts...)
+	metricAttrs := ch.consumeMetricAttrs(queue, op)
+	ack := &acknowledger{
+		ch:          ch,
+		acker:       msg.Acknowledger, // The channel that delivered msg.
+		ctx:         ctx,
+		span:        span,
+		queue:       queue,
+		key:         msg.DeliveryTag,
+		start:       start,
+		metricAttrs: metricAttrs,
+		autoAck:     autoAck,
+		endOnce:     sync.Once{},
+		spanEndOnce: sync.Once{},
+		handlerErr:  nil,
 	}
+	msg.Acknowledger = ack
 
+	// Deliveries consumed with autoAck are never settled by the consumer, so they are not tracked.
+	if autoAck {
+		return ack
+	}
 	ch.m.Lock()
 	defer ch.m.Unlock()
-	ch.spanMap[msg.DeliveryTag] = span
+	ch.spanMap[msg.DeliveryTag] = ack
+	return ack
 } //nolint:spancheck // span ends when msg is ack/nack/rejected
 
 func (ch *Channel) Consume(
@@ -135,17 +289,130 @@ func (ch *Channel) Consume(
 	if err != nil {
 		return deliveries, err
 	}
-	newDeliveries := make(chan amqp091.Delivery)
-	go func() {
-		for msg := range deliveries {
-			ch.startConsumerSpan(&msg, queue, semconv.MessagingOperationTypeDeliver)
-			newDeliveries <- msg
+	newDeliveries := make(chan amqp091.Delivery, ch.deliveryBufferSize())
+	go ch.forward(deliveries, newDeliveries, queue, autoAck)
+	return newDeliveries, nil
+}
+
+// forward starts the span of each of deliveries and forwards it to newDeliveries, until deliveries is closed.
+func (ch *Channel) forward(
+	deliveries <-chan amqp091.Delivery, newDeliveries chan<- amqp091.Delivery, queue string, autoAck bool,
+) {
+	defer close(newDeliveries)
+	for msg := range deliveries {
+		ack := ch.startConsumerSpan(&msg, queue, operationDeliver, autoAck)
+		newDeliveries <- msg
+		if autoAck && ch.cfg.AutoAckSpanEnd == AutoAckSpanEndOnHandoff {
+			ack.endAutoAck(nil)
 		}
-		close(newDeliveries)
-	}()
+	}
+}
+
+// Qos is the instrumented version of [amqp091.Channel.Qos].
+// The prefetch count is remembered to size the buffer of deliveries returned by Consume,
+// see [WithDeliveryBufferSize].
+func (ch *Channel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	err := ch.Channel.Qos(prefetchCount, prefetchSize, global)
+	if err == nil {
+		ch.prefetchCount.Store(int64(prefetchCount))
+	}
+	return err
+}
+
+// deliveryBufferSize returns the buffer size of the deliveries returned by Consume.
+func (ch *Channel) deliveryBufferSize() int {
+	if ch.cfg.DeliveryBufferSize >= 0 {
+		return ch.cfg.DeliveryBufferSize
+	}
+	return int(ch.prefetchCount.Load())
+}
+
+// ConsumeWithContext is the instrumented version of [amqp091.Channel.ConsumeWithContext].
+//
+// When ctx is done, the consumer is cancelled on the broker, and the returned channel is closed
+// without waiting for the caller to receive pending deliveries.
+// Spans of deliveries that are never handed to the caller end with the error of ctx,
+// and such deliveries are requeued unless consumed with autoAck.
+// This includes the deliveries received ahead of the caller, see [WithDeliveryBufferSize].
+func (ch *Channel) ConsumeWithContext( //nolint:revive // same arguments as amqp091.Channel.ConsumeWithContext
+	ctx context.Context, queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp091.Table,
+) (<-chan amqp091.Delivery, error) {
+	deliveries, err := ch.Channel.ConsumeWithContext(ctx, queue, consumer, autoAck, exclusive, noLocal, noWait, args)
+	if err != nil {
+		return deliveries, err
+	}
+	// The returned channel is unbuffered, deliveries received ahead of the caller are kept by forwardWithContext,
+	// so they can be cancelled when ctx is done.
+	newDeliveries := make(chan amqp091.Delivery)
+	go ch.forwardWithContext(ctx, deliveries, newDeliveries, queue, autoAck, ch.deliveryBufferSize())
 	return newDeliveries, nil
 }
 
+// pendingDelivery is a delivery received by forwardWithContext, waiting to be handed to the consumer.
+type pendingDelivery struct {
+	msg amqp091.Delivery
+	ack *acknowledger
+}
+
+// forwardWithContext forwards deliveries to newDeliveries until ctx is done,
+// receiving up to bufferSize deliveries ahead of the consumer,
+// then cancels the pending deliveries and the rest of deliveries until it is closed by the consumer cancellation.
+func (ch *Channel) forwardWithContext(
+	ctx context.Context, deliveries <-chan amqp091.Delivery, newDeliveries chan<- amqp091.Delivery,
+	queue string, autoAck bool, bufferSize int,
+) {
+	defer close(newDeliveries)
+	var pending []pendingDelivery
+	for deliveries != nil || len(pending) > 0 {
+		// Nil channels disable their cases, so deliveries is received only when there is room for it,
+		// and newDeliveries is sent to only when there is a pending delivery.
+		var in <-chan amqp091.Delivery
+		if len(pending) <= bufferSize {
+			in = deliveries
+		}
+		var out chan<- amqp091.Delivery
+		var next amqp091.Delivery
+		if len(pending) > 0 {
+			out, next = newDeliveries, pending[0].msg
+		}
+		select {
+		case msg, ok := <-in:
+			if !ok {
+				deliveries = nil
+				continue
+			}
+			ack := ch.startDeliverySpan(&msg, queue, operationDeliver, autoAck)
+			pending = append(pending, pendingDelivery{msg: msg, ack: ack})
+		case out <- next:
+			pending[0].ack.recordConsume(1)
+			if autoAck && ch.cfg.AutoAckSpanEnd == AutoAckSpanEndOnHandoff {
+				pending[0].ack.endAutoAck(nil)
+			}
+			pending = pending[1:]
+		case <-ctx.Done():
+			ch.cancelDeliveries(ctx.Err(), pending, deliveries, queue, autoAck)
+			return
+		}
+	}
+}
+
+// cancelDeliveries cancels the pending deliveries, and the rest of deliveries until it is closed.
+// deliveries may be nil if it is already closed.
+func (ch *Channel) cancelDeliveries(
+	err error, pending []pendingDelivery, deliveries <-chan amqp091.Delivery, queue string, autoAck bool,
+) {
+	for _, p := range pending {
+		p.ack.cancel(err, p.msg.DeliveryTag)
+	}
+	if deliveries == nil {
+		return
+	}
+	for msg := range deliveries {
+		ack := ch.startDeliverySpan(&msg, queue, operationDeliver, autoAck)
+		ack.cancel(err, msg.DeliveryTag)
+	}
+}
+
 func (ch *Channel) PublishWithContext(
 	ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp091.Publishing,
 ) error {
@@ -155,15 +422,30 @@ func (ch *Channel) PublishWithContext(
 
 func (ch *Channel) PublishWithDeferredConfirmWithContext(
 	ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp091.Publishing,
+) (*amqp091.DeferredConfirmation, error) {
+	return ch.publish(ctx, ch.Channel.PublishWithDeferredConfirmWithContext, exchange, key, mandatory, immediate, msg)
+}
+
+// publishFunc publishes a message, implemented by [amqp091.Channel.PublishWithDeferredConfirmWithContext].
+type publishFunc func(
+	ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp091.Publishing,
+) (*amqp091.DeferredConfirmation, error)
+
+// publish traces publishing msg with publish.
+// The headers table of msg is not modified, trace context is injected into a copy of it.
+func (ch *Channel) publish(
+	ctx context.Context, publish publishFunc, exchange, key string, mandatory, immediate bool, msg amqp091.Publishing,
 ) (*amqp091.DeferredConfirmation, error) {
 	// Create a span.
 	attrs := []attribute.KeyValue{
-		semconv.MessagingOperationTypePublish,
-		semconv.MessagingOperationName("publish"),
+		ch.cfg.SemconvStability.operationType(operationPublish),
+		semconv.MessagingOperationName(ch.cfg.SemconvStability.operationName(operationPublish)),
 		semconv.MessagingDestinationAnonymous(exchange == ""),
 		semconv.MessagingDestinationName(exchange),
-		// todo messaging.client.id
-		semconv.MessagingRabbitmqDestinationRoutingKey(key),
+		semconv.MessagingRabbitMQDestinationRoutingKey(key),
+	}
+	if ch.clientID != "" {
+		attrs = append(attrs, semconv.MessagingClientID(ch.clientID))
 	}
 	if msg.CorrelationId != "" {
 		attrs = append(attrs, semconv.MessagingMessageConversationID(msg.CorrelationId))
@@ -179,24 +461,71 @@ func (ch *Channel) PublishWithDeferredConfirmWithContext(
 	ctx, span := ch.cfg.Tracer.Start(ctx, ch.nameWhenPublish(exchange), opts...)
 
 	// Inject current span context
-	carrier := newPublishingMessageCarrier(&msg)
+	setBaggageHeaders(ctx, &msg, ch.cfg.BaggageHeaders, ch.cfg.HeaderValueType)
+	carrier := newPublishingMessageCarrier(&msg, ch.cfg.HeaderValueType, ch.cfg.HeaderLayout)
 	ch.cfg.Propagators.Inject(ctx, carrier)
 
-	dc, err := ch.Channel.PublishWithDeferredConfirmWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	start := time.Now()
+	dc, err := publish(ctx, exchange, key, mandatory, immediate, msg)
+	ch.cfg.Metrics.recordPublish(ctx, start, ch.publishMetricAttrs(exchange), err)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		// todo error.type
+		span.SetAttributes(errorAttrs(err)...)
+	}
+	if dc != nil && ch.cfg.PublishConfirmSpan {
+		go ch.endPublishSpanOnConfirm(span, dc)
+		return dc, err
 	}
 	span.End()
 	return dc, err
 }
 
+// confirmation is the publisher confirmation of a publishing, implemented by [amqp091.DeferredConfirmation].
+type confirmation interface {
+	Done() <-chan struct{}
+	Acked() bool
+}
+
+// endPublishSpanOnConfirm ends the span of a publishing when it is confirmed or the confirmation times out.
+func (ch *Channel) endPublishSpanOnConfirm(span trace.Span, dc confirmation) {
+	defer span.End()
+
+	start := time.Now()
+	var timeout <-chan time.Time
+	if ch.cfg.PublishConfirmTimeout > 0 {
+		timer := time.NewTimer(ch.cfg.PublishConfirmTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-dc.Done():
+		acked := dc.Acked()
+		span.SetAttributes(
+			confirmAckedKey.Bool(acked),
+			confirmDurationKey.Float64(time.Since(start).Seconds()),
+		)
+		if !acked {
+			span.SetStatus(codes.Error, "nack")
+			span.SetAttributes(semconv.ErrorTypeKey.String("nack"))
+		}
+	case <-timeout:
+		span.SetStatus(codes.Error, "confirm timeout")
+		span.SetAttributes(semconv.ErrorTypeKey.String("timeout"))
+	}
+}
+
+// Get is the instrumented version of [amqp091.Channel.Get].
+// The span of the delivery is a CONSUMER span that lasts until the delivery is settled,
+// so it is modelled as process under the current semantic conventions, like deliveries of Consume.
 func (ch *Channel) Get(queue string, autoAck bool) (msg amqp091.Delivery, ok bool, err error) {
 	msg, ok, err = ch.Channel.Get(queue, autoAck)
 	if err != nil || !ok {
 		return
 	}
-	ch.startConsumerSpan(&msg, queue, semconv.MessagingOperationTypeReceive)
+	ack := ch.startConsumerSpan(&msg, queue, operationReceive, autoAck)
+	if autoAck && ch.cfg.AutoAckSpanEnd == AutoAckSpanEndOnHandoff {
+		ack.endAutoAck(nil)
+	}
 	return msg, ok, err
 }
@@ -0,0 +1,542 @@
+package amqp091otel
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/rabbitmq/amqp091-go"
+
+	"github.com/wzy9607/amqp091otel/internal/mocks/amqp091"
+)
+
+func newTestChannel(t testing.TB, opts ...Option) *Channel {
+	t.Helper()
+	uri, err := parseURI("amqp://localhost")
+	require.NoError(t, err)
+	cfg := newConfig(opts)
+	return &Channel{uri: uri, cfg: cfg, clientID: clientID(cfg, nil), spanMap: make(map[uint64]*acknowledger)}
+}
+
+func TestChannel_startConsumerSpan(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		autoAck bool
+	}
+	tests := []struct {
+		name           string
+		args           args
+		wantSpanMapLen int
+	}{
+		{
+			name:           "track deliveries to be settled",
+			args:           args{autoAck: false},
+			wantSpanMapLen: 1,
+		}, {
+			name:           "do not track autoAck deliveries",
+			args:           args{autoAck: true},
+			wantSpanMapLen: 0,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp, _ := initMockTracerProvider()
+			ch := newTestChannel(t, WithTracerProvider(tp))
+			msg := amqp091.Delivery{DeliveryTag: 1}
+
+			ack := ch.startConsumerSpan(&msg, "queue", operationDeliver, tt.args.autoAck)
+
+			assert.Same(t, ack, msg.Acknowledger)
+			assert.Equal(t, tt.args.autoAck, ack.autoAck)
+			assert.Len(t, ch.spanMap, tt.wantSpanMapLen)
+		})
+	}
+}
+
+func TestChannel_startConsumerSpan_attrs(t *testing.T) {
+	t.Parallel()
+	tp, exp := initMockTracerProvider()
+	ch := newTestChannel(t, WithTracerProvider(tp), WithClientID("client"))
+	msg := amqp091.Delivery{DeliveryTag: 1, ConsumerTag: "ctag-1"}
+
+	ch.startConsumerSpan(&msg, "queue", operationDeliver, true)
+	EndDelivery(msg, nil)
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 1)
+	assert.Contains(t, spans[0].Attributes, semconv.MessagingClientID("client"))
+	assert.Contains(t, spans[0].Attributes, consumerTagKey.String("ctag-1"))
+}
+
+func TestChannel_startConsumerSpan_headerAttributes(t *testing.T) {
+	t.Parallel()
+	tp, exp := initMockTracerProvider()
+	ch := newTestChannel(t, WithTracerProvider(tp), WithHeaderAttributes("tenant-id", "x-retries", "x-source", "missing"))
+	msg := amqp091.Delivery{Headers: amqp091.Table{
+		"tenant-id": "t1",
+		"x-retries": int32(2),
+		"x-source":  []byte("web"),
+		"other":     "ignored",
+	}}
+
+	ch.startConsumerSpan(&msg, "queue", operationDeliver, true)
+	EndDelivery(msg, nil)
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 1)
+	attrs := spans[0].Attributes
+	assert.Contains(t, attrs, (headerKeyPrefix + "tenant-id").String("t1"))
+	assert.Contains(t, attrs, (headerKeyPrefix + "x-retries").Int64(2))
+	assert.Contains(t, attrs, (headerKeyPrefix + "x-source").String("web"))
+	for _, attr := range attrs {
+		assert.NotEqual(t, headerKeyPrefix+"other", attr.Key)
+		assert.NotEqual(t, headerKeyPrefix+"missing", attr.Key)
+	}
+}
+
+func TestChannel_startConsumerSpan_relationship(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		relationship ConsumerSpanRelationship
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantParent bool
+		wantLink   bool
+	}{
+		{
+			name:       "parent",
+			args:       args{relationship: ConsumerSpanParent},
+			wantParent: true,
+		}, {
+			name:     "link",
+			args:     args{relationship: ConsumerSpanLink},
+			wantLink: true,
+		}, {
+			name:       "parent and link",
+			args:       args{relationship: ConsumerSpanParentAndLink},
+			wantParent: true,
+			wantLink:   true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp, exp := initMockTracerProvider()
+			ch := newTestChannel(t, WithTracerProvider(tp), WithPropagators(propagation.TraceContext{}),
+				WithConsumerSpanRelationship(tt.args.relationship))
+			ctx, publishSpan := tp.Tracer("test").Start(context.Background(), "publish")
+			publishSpan.End()
+			msg := amqp091.Delivery{Headers: amqp091.Table{}}
+			ch.cfg.Propagators.Inject(ctx, newDeliveryMessageCarrier(&msg, ch.cfg.HeaderLayout))
+
+			ch.startConsumerSpan(&msg, "queue", operationDeliver, true)
+			EndDelivery(msg, nil)
+
+			spans := exp.GetSpans()
+			require.Len(t, spans, 2)
+			span := spans[1]
+			publishSC := publishSpan.SpanContext()
+			if tt.wantParent {
+				assert.Equal(t, publishSC.SpanID(), span.Parent.SpanID())
+				assert.Equal(t, publishSC.TraceID(), span.SpanContext.TraceID())
+			} else {
+				assert.False(t, span.Parent.IsValid())
+				assert.NotEqual(t, publishSC.TraceID(), span.SpanContext.TraceID())
+			}
+			if tt.wantLink {
+				require.Len(t, span.Links, 1)
+				assert.Equal(t, publishSC.SpanID(), span.Links[0].SpanContext.SpanID())
+			} else {
+				assert.Empty(t, span.Links)
+			}
+		})
+	}
+}
+
+func TestChannel_extract(t *testing.T) {
+	t.Parallel()
+	propagated := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{1}, SpanID: trace.SpanID{1}, TraceFlags: trace.FlagsSampled,
+	})
+	legacy := trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{2}, SpanID: trace.SpanID{2}})
+	legacyExtractor := func(msg amqp091.Delivery) trace.SpanContext {
+		if msg.MessageId != "legacy" {
+			return trace.SpanContext{}
+		}
+		return legacy
+	}
+	failingExtractor := func(amqp091.Delivery) trace.SpanContext { return trace.SpanContext{} }
+	type args struct {
+		msg        amqp091.Delivery
+		extractors []Extractor
+	}
+	tests := []struct {
+		name string
+		args args
+		want trace.SpanContext
+	}{
+		{
+			name: "propagator first",
+			args: args{
+				msg: amqp091.Delivery{
+					MessageId: "legacy",
+					Headers:   amqp091.Table{"traceparent": "00-01000000000000000000000000000000-0100000000000000-01"},
+				},
+				extractors: []Extractor{legacyExtractor},
+			},
+			want: propagated.WithRemote(true),
+		}, {
+			name: "fall back to the first valid extractor",
+			args: args{
+				msg:        amqp091.Delivery{MessageId: "legacy"},
+				extractors: []Extractor{failingExtractor, legacyExtractor},
+			},
+			want: legacy.WithRemote(true),
+		}, {
+			name: "none",
+			args: args{
+				msg:        amqp091.Delivery{},
+				extractors: []Extractor{failingExtractor, legacyExtractor},
+			},
+			want: trace.SpanContext{},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			ch := newTestChannel(t, WithPropagators(propagation.TraceContext{}), WithExtractors(tt.args.extractors...))
+			assert.Equal(t, tt.want, trace.SpanContextFromContext(ch.extract(&tt.args.msg)))
+		})
+	}
+}
+
+func Test_clientID(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		opts []Option
+		conn *amqp091.Connection
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "option",
+			args: args{
+				opts: []Option{WithClientID("client")},
+				conn: &amqp091.Connection{Config: amqp091.Config{Properties: amqp091.Table{"connection_name": "conn"}}},
+			},
+			want: "client",
+		}, {
+			name: "connection name",
+			args: args{
+				conn: &amqp091.Connection{Config: amqp091.Config{Properties: amqp091.Table{"connection_name": "conn"}}},
+			},
+			want: "conn",
+		}, {
+			name: "no connection name",
+			args: args{
+				conn: &amqp091.Connection{},
+			},
+			want: "",
+		}, {
+			name: "unknown connection",
+			args: args{},
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.want, clientID(newConfig(tt.args.opts), tt.args.conn))
+		})
+	}
+}
+
+func TestChannel_watchClose(t *testing.T) {
+	t.Parallel()
+	tp, exp := initMockTracerProvider()
+	ch := newTestChannel(t, WithTracerProvider(tp))
+	for tag := uint64(1); tag <= 2; tag++ {
+		msg := amqp091.Delivery{DeliveryTag: tag}
+		ch.startConsumerSpan(&msg, "queue", operationDeliver, false)
+	}
+
+	closes := make(chan *amqp091.Error, 1)
+	done := make(chan struct{})
+	go func() {
+		ch.watchClose(closes)
+		close(done)
+	}()
+	amqpErr := &amqp091.Error{Code: amqp091.NotFound, Reason: "NOT_FOUND - no queue 'queue'"}
+	closes <- amqpErr
+	close(closes)
+	<-done
+
+	assert.Empty(t, ch.spanMap)
+	spans := exp.GetSpans()
+	require.Len(t, spans, 2)
+	for _, span := range spans {
+		assert.False(t, span.EndTime.IsZero())
+		assert.Equal(t, codes.Error, span.Status.Code)
+		assert.Equal(t, amqpErr.Error(), span.Status.Description)
+	}
+}
+
+func TestChannel_forwardWithContext(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		bufferSize int
+		received   int
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "unbuffered",
+			args: args{bufferSize: 0, received: 1},
+		}, {
+			name: "cancel buffered deliveries",
+			args: args{bufferSize: 2, received: 0},
+		}, {
+			name: "cancel buffered deliveries after handoff",
+			args: args{bufferSize: 1, received: 1},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			const count = 3
+			tp, exp := initMockTracerProvider()
+			mp, reader := initMockMeterProvider()
+			ch := newTestChannel(t, WithTracerProvider(tp), WithMeterProvider(mp))
+			acker := mockamqp091.NewMockAcknowledger(t)
+			for tag := uint64(tt.args.received) + 1; tag <= count; tag++ {
+				acker.EXPECT().Nack(tag, false, true).Return(nil)
+			}
+			deliveries := make(chan amqp091.Delivery, count)
+			for tag := uint64(1); tag <= count; tag++ {
+				deliveries <- amqp091.Delivery{Acknowledger: acker, DeliveryTag: tag}
+			}
+			close(deliveries)
+			ctx, cancel := context.WithCancel(context.Background())
+			newDeliveries := make(chan amqp091.Delivery)
+			done := make(chan struct{})
+			go func() {
+				ch.forwardWithContext(ctx, deliveries, newDeliveries, "queue", false, tt.args.bufferSize)
+				close(done)
+			}()
+
+			received := make(map[uint64]struct{}, tt.args.received)
+			for range tt.args.received {
+				msg := <-newDeliveries
+				received[msg.DeliveryTag] = struct{}{}
+			}
+			// Wait for the buffer to be filled, or every delivery to be received if it can hold all of them.
+			require.Eventually(t, func() bool {
+				return len(deliveries) <= count-tt.args.received-tt.args.bufferSize-1
+			}, time.Second, time.Millisecond)
+			cancel()
+			<-done
+
+			_, ok := <-newDeliveries
+			assert.False(t, ok, "deliveries should be closed once ctx is done")
+			assert.Len(t, ch.spanMap, tt.args.received, "only the handed deliveries are left to the consumer")
+			assert.Equal(t, int64(tt.args.received), consumedMessages(t, reader),
+				"cancelled deliveries should not be counted as consumed")
+			for tag := range received {
+				assert.Contains(t, ch.spanMap, tag)
+			}
+			spans := exp.GetSpans()
+			require.Len(t, spans, count-tt.args.received)
+			for _, span := range spans {
+				assert.Equal(t, codes.Error, span.Status.Code)
+				assert.Equal(t, context.Canceled.Error(), span.Status.Description)
+			}
+		})
+	}
+}
+
+func TestChannel_deliveryBufferSize(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		opts          []Option
+		prefetchCount int64
+	}
+	tests := []struct {
+		name string
+		args args
+		want int
+	}{
+		{
+			name: "unbuffered without Qos",
+			args: args{},
+			want: 0,
+		}, {
+			name: "follow prefetch count",
+			args: args{prefetchCount: 50},
+			want: 50,
+		}, {
+			name: "set by option",
+			args: args{opts: []Option{WithDeliveryBufferSize(10)}, prefetchCount: 50},
+			want: 10,
+		}, {
+			name: "negative follows prefetch count",
+			args: args{opts: []Option{WithDeliveryBufferSize(-1)}, prefetchCount: 50},
+			want: 50,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			ch := newTestChannel(t, tt.args.opts...)
+			ch.prefetchCount.Store(tt.args.prefetchCount)
+			assert.Equal(t, tt.want, ch.deliveryBufferSize())
+		})
+	}
+}
+
+// BenchmarkChannel_forward measures the handoff of deliveries to the consumer,
+// against reading deliveries from the uninstrumented channel.
+func BenchmarkChannel_forward(b *testing.B) {
+	benchmarks := []struct {
+		name         string
+		instrumented bool
+		bufferSize   int
+	}{
+		{name: "uninstrumented"},
+		{name: "unbuffered", instrumented: true, bufferSize: 0},
+		{name: "buffer 100", instrumented: true, bufferSize: 100},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			ch := newTestChannel(b)
+			deliveries := make(chan amqp091.Delivery)
+			go func() {
+				for tag := range uint64(b.N) {
+					deliveries <- amqp091.Delivery{DeliveryTag: tag + 1}
+				}
+				close(deliveries)
+			}()
+			var received <-chan amqp091.Delivery = deliveries
+			if bm.instrumented {
+				newDeliveries := make(chan amqp091.Delivery, bm.bufferSize)
+				go ch.forward(deliveries, newDeliveries, "queue", true)
+				received = newDeliveries
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range received {
+				// Drain deliveries.
+			}
+		})
+	}
+}
+
+// TestChannel_publish_sharedPublishing should be run with the race detector.
+func TestChannel_publish_sharedPublishing(t *testing.T) {
+	t.Parallel()
+	tp, _ := initMockTracerProvider()
+	ch := newTestChannel(t, WithTracerProvider(tp), WithPropagators(propagation.TraceContext{}))
+	template := amqp091.Publishing{Headers: amqp091.Table{"foo": "bar"}}
+	publish := func(
+		_ context.Context, _, _ string, _, _ bool, msg amqp091.Publishing,
+	) (*amqp091.DeferredConfirmation, error) {
+		for range msg.Headers {
+			// Read every header, as the real publish encodes them.
+		}
+		return nil, nil
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			_, err := ch.publish(context.Background(), publish, "exchange", "key", false, false, template)
+			assert.NoError(t, err)
+		})
+	}
+	wg.Wait()
+
+	assert.Equal(t, amqp091.Table{"foo": "bar"}, template.Headers)
+}
+
+type fakeConfirmation struct {
+	done  chan struct{}
+	acked bool
+}
+
+func (c *fakeConfirmation) Done() <-chan struct{} { return c.done }
+
+func (c *fakeConfirmation) Acked() bool { return c.acked }
+
+func TestChannel_endPublishSpanOnConfirm(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		resolved bool
+		acked    bool
+	}
+	tests := []struct {
+		name           string
+		args           args
+		wantSpanStatus tracesdk.Status
+		wantAttrsLen   int
+	}{
+		{
+			name:           "ack",
+			args:           args{resolved: true, acked: true},
+			wantSpanStatus: tracesdk.Status{Code: codes.Unset, Description: ""},
+			wantAttrsLen:   2,
+		}, {
+			name:           "nack",
+			args:           args{resolved: true, acked: false},
+			wantSpanStatus: tracesdk.Status{Code: codes.Error, Description: "nack"},
+			wantAttrsLen:   3,
+		}, {
+			name:           "timeout",
+			args:           args{resolved: false},
+			wantSpanStatus: tracesdk.Status{Code: codes.Error, Description: "confirm timeout"},
+			wantAttrsLen:   1,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp, exp := initMockTracerProvider()
+			ch := newTestChannel(t, WithTracerProvider(tp), WithPublishConfirmSpan(10*time.Millisecond))
+			_, span := tp.Tracer("test").Start(context.Background(), "publish")
+			dc := &fakeConfirmation{done: make(chan struct{}), acked: tt.args.acked}
+			if tt.args.resolved {
+				close(dc.done)
+			}
+
+			ch.endPublishSpanOnConfirm(span, dc)
+
+			spans := exp.GetSpans()
+			require.Len(t, spans, 1)
+			assert.False(t, spans[0].EndTime.IsZero())
+			assert.Equal(t, tt.wantSpanStatus, spans[0].Status)
+			assert.Len(t, spans[0].Attributes, tt.wantAttrsLen)
+		})
+	}
+}
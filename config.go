@@ -1,9 +1,15 @@
 package amqp091otel
 
 import (
+	"context"
+	"time"
+
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
+
+	"github.com/rabbitmq/amqp091-go"
 )
 
 const (
@@ -13,16 +19,62 @@ const (
 
 type config struct {
 	TracerProvider trace.TracerProvider
+	MeterProvider  metric.MeterProvider
 	Propagators    propagation.TextMapPropagator
+	AutoAckSpanEnd AutoAckSpanEnd
+	// PublishConfirmSpan is whether to keep the span of a publishing open until it is confirmed.
+	PublishConfirmSpan    bool
+	PublishConfirmTimeout time.Duration
+	TopologySpans         bool
+	ClientID              string
+	SemconvStability      SemconvStability
+	SettleSpans           bool
+	// ConsumerSpanRelationship is how the span of a delivery relates to the span of its publishing.
+	ConsumerSpanRelationship ConsumerSpanRelationship
+	// PublishBatchCreateSpans is whether each publishing of PublishBatch gets its own create span.
+	PublishBatchCreateSpans bool
+	// HeaderValueType is the type of the header values that trace context is injected as.
+	HeaderValueType HeaderValueType
+	// HeaderLayout is where trace context is stored in the headers of a message.
+	HeaderLayout headerLayout
+	// Extractors extract the span context of a delivery when the propagators don't.
+	Extractors []Extractor
+	// BaggageHeaders are the keys of baggage members copied into the headers of publishings.
+	BaggageHeaders []string
+	// HeaderAttributes are the names of delivery headers recorded as span attributes.
+	HeaderAttributes []string
+	// DeliveryBufferSize is the buffer size of the deliveries returned by Consume and ConsumeWithContext,
+	// negative to follow the prefetch count of the channel.
+	DeliveryBufferSize int
 
-	Tracer trace.Tracer
+	Tracer  trace.Tracer
+	Meter   metric.Meter
+	Metrics *metrics
 }
 
 func newConfig(opts []Option) *config {
 	cfg := &config{
-		TracerProvider: otel.GetTracerProvider(),
-		Propagators:    otel.GetTextMapPropagator(),
-		Tracer:         nil,
+		TracerProvider:           otel.GetTracerProvider(),
+		MeterProvider:            otel.GetMeterProvider(),
+		Propagators:              otel.GetTextMapPropagator(),
+		AutoAckSpanEnd:           AutoAckSpanEndOnHandoff,
+		PublishConfirmSpan:       false,
+		PublishConfirmTimeout:    0,
+		TopologySpans:            false,
+		ClientID:                 "",
+		SemconvStability:         semconvStabilityFromEnv(),
+		SettleSpans:              false,
+		DeliveryBufferSize:       -1,
+		ConsumerSpanRelationship: ConsumerSpanParent,
+		PublishBatchCreateSpans:  false,
+		HeaderValueType:          HeaderValueString,
+		HeaderLayout:             headerLayout{table: "", prefix: ""},
+		Extractors:               nil,
+		BaggageHeaders:           nil,
+		HeaderAttributes:         nil,
+		Tracer:                   nil,
+		Meter:                    nil,
+		Metrics:                  nil,
 	}
 	for _, opt := range opts {
 		opt(cfg)
@@ -32,6 +84,11 @@ func newConfig(opts []Option) *config {
 		libName,
 		trace.WithInstrumentationVersion(version),
 	)
+	cfg.Meter = cfg.MeterProvider.Meter(
+		libName,
+		metric.WithInstrumentationVersion(version),
+	)
+	cfg.Metrics = newMetrics(cfg.Meter)
 
 	return cfg
 }
@@ -48,6 +105,15 @@ func WithTracerProvider(provider trace.TracerProvider) Option {
 	}
 }
 
+// WithMeterProvider sets the meter provider.
+func WithMeterProvider(provider metric.MeterProvider) Option {
+	return func(cfg *config) {
+		if provider != nil {
+			cfg.MeterProvider = provider
+		}
+	}
+}
+
 // WithPropagators sets the propagators.
 func WithPropagators(propagators propagation.TextMapPropagator) Option {
 	return func(cfg *config) {
@@ -56,3 +122,209 @@ func WithPropagators(propagators propagation.TextMapPropagator) Option {
 		}
 	}
 }
+
+// AutoAckSpanEnd specifies when the span of a delivery consumed with autoAck ends.
+type AutoAckSpanEnd int
+
+const (
+	// AutoAckSpanEndOnHandoff ends the span when the delivery is handed to the caller of Consume or Get.
+	AutoAckSpanEndOnHandoff AutoAckSpanEnd = iota
+	// AutoAckSpanEndManual ends the span when [EndDelivery] is called.
+	AutoAckSpanEndManual
+)
+
+// WithAutoAckSpanEnd sets when the span of a delivery consumed with autoAck ends.
+// The default is [AutoAckSpanEndOnHandoff].
+func WithAutoAckSpanEnd(mode AutoAckSpanEnd) Option {
+	return func(cfg *config) {
+		cfg.AutoAckSpanEnd = mode
+	}
+}
+
+// ConsumerSpanRelationship specifies how the span of a delivery relates to the span of its publishing,
+// whose context is extracted from the delivery.
+type ConsumerSpanRelationship int
+
+const (
+	// ConsumerSpanParent makes the publishing span the parent of the delivery span, in the same trace.
+	ConsumerSpanParent ConsumerSpanRelationship = iota
+	// ConsumerSpanLink starts the delivery span in a new trace, linked to the publishing span.
+	// It keeps traces short when messages are consumed long after they are published, or fanned out to many consumers.
+	ConsumerSpanLink
+	// ConsumerSpanParentAndLink makes the publishing span both the parent of and linked from the delivery span.
+	ConsumerSpanParentAndLink
+)
+
+// startOptions returns the options to start the span of a delivery, whose extracted context is parentCtx.
+func (r ConsumerSpanRelationship) startOptions(parentCtx context.Context) []trace.SpanStartOption {
+	switch r {
+	case ConsumerSpanLink:
+		return []trace.SpanStartOption{trace.WithNewRoot(), linkTo(parentCtx)}
+	case ConsumerSpanParentAndLink:
+		return []trace.SpanStartOption{linkTo(parentCtx)}
+	default:
+		return nil
+	}
+}
+
+// linkTo returns the option to link the span in ctx, if there is one.
+func linkTo(ctx context.Context) trace.SpanStartOption {
+	var links []trace.Link
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		links = append(links, trace.Link{SpanContext: sc, Attributes: nil})
+	}
+	return trace.WithLinks(links...)
+}
+
+// WithConsumerSpanRelationship sets how the span of a delivery relates to the span of its publishing.
+// The default is [ConsumerSpanParent].
+// Baggage extracted from the delivery is kept in the context of the delivery in any case.
+func WithConsumerSpanRelationship(relationship ConsumerSpanRelationship) Option {
+	return func(cfg *config) {
+		cfg.ConsumerSpanRelationship = relationship
+	}
+}
+
+// WithPublishConfirmSpan keeps the span of a publishing open until the broker confirms it,
+// when the channel is in confirm mode, see [amqp091.Channel.Confirm].
+// The span ends with an error status if the publishing is nacked,
+// or the confirmation doesn't arrive within timeout. A timeout <= 0 means no timeout.
+func WithPublishConfirmSpan(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.PublishConfirmSpan = true
+		cfg.PublishConfirmTimeout = timeout
+	}
+}
+
+// WithPublishBatchCreateSpans sets whether each publishing of [Channel.PublishBatch] gets its own create span,
+// linked from the batch span. Otherwise, the context of the batch span is injected into every publishing,
+// which saves spans at high volume.
+func WithPublishBatchCreateSpans(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.PublishBatchCreateSpans = enabled
+	}
+}
+
+// HeaderValueType specifies the type of the header values that trace context is injected into publishings as.
+type HeaderValueType int
+
+const (
+	// HeaderValueString injects header values as AMQP long strings.
+	HeaderValueString HeaderValueType = iota
+	// HeaderValueBytes injects header values as AMQP byte arrays,
+	// for consumers that expect bytes, e.g. some clients in other languages.
+	HeaderValueBytes
+)
+
+// WithHeaderValueType sets the type of the header values that trace context is injected into publishings as.
+// The default is [HeaderValueString]. Header values of either type are extracted from deliveries.
+func WithHeaderValueType(valueType HeaderValueType) Option {
+	return func(cfg *config) {
+		cfg.HeaderValueType = valueType
+	}
+}
+
+// WithHeaderTable nests trace context under a table named name in the headers of publishings, e.g. "otel",
+// so it doesn't clash with application headers. An empty name stores it in the top-level headers, which is the default.
+// Trace context is extracted from the table first, then from the top-level headers,
+// so producers and consumers can adopt it gradually.
+func WithHeaderTable(name string) Option {
+	return func(cfg *config) {
+		cfg.HeaderLayout.table = name
+	}
+}
+
+// WithHeaderPrefix prepends prefix to the header keys of trace context in publishings, e.g. "otel-".
+// It applies within the table set by [WithHeaderTable], if any.
+// Trace context is extracted from the prefixed keys first, then from the top-level headers as is,
+// so producers and consumers can adopt it gradually.
+func WithHeaderPrefix(prefix string) Option {
+	return func(cfg *config) {
+		cfg.HeaderLayout.prefix = prefix
+	}
+}
+
+// Extractor extracts the span context of the publishing of msg, e.g. from legacy tracing headers,
+// or from MessageId or CorrelationId that carries a trace ID.
+// It returns an invalid span context if msg doesn't carry one.
+type Extractor func(msg amqp091.Delivery) trace.SpanContext
+
+// WithExtractors adds extractors of the span context of deliveries that the propagators fail to extract,
+// e.g. from messages published by producers that are not instrumented by OpenTelemetry.
+// The extractors are tried in order, and the first valid span context is used.
+func WithExtractors(extractors ...Extractor) Option {
+	return func(cfg *config) {
+		cfg.Extractors = append(cfg.Extractors, extractors...)
+	}
+}
+
+// WithBaggageHeaders copies the baggage members with keys in the context of a publishing into its headers,
+// under the same names, e.g. for consumers that are not instrumented by OpenTelemetry.
+// Headers that the publishing already has are kept.
+func WithBaggageHeaders(keys ...string) Option {
+	return func(cfg *config) {
+		cfg.BaggageHeaders = append(cfg.BaggageHeaders, keys...)
+	}
+}
+
+// WithHeaderAttributes records the headers of a delivery with names, e.g. tenant-id,
+// as the messaging.rabbitmq.header.<name> attributes of its span.
+func WithHeaderAttributes(names ...string) Option {
+	return func(cfg *config) {
+		cfg.HeaderAttributes = append(cfg.HeaderAttributes, names...)
+	}
+}
+
+// WithTopologySpans sets whether to trace topology operations,
+// i.e. the *WithContext variants of declaring, binding, purging and deleting queues and exchanges.
+func WithTopologySpans(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.TopologySpans = enabled
+	}
+}
+
+// WithClientID sets the messaging.client.id attribute of spans.
+// If it is not set, the connection_name client property of the connection is used, see [amqp091.Config].
+func WithClientID(id string) Option {
+	return func(cfg *config) {
+		cfg.ClientID = id
+	}
+}
+
+// WithSemconvStability sets the version of the messaging semantic conventions that spans and the attributes
+// of metrics follow. The names of metrics always follow the current conventions.
+// The default is read from the OTEL_SEMCONV_STABILITY_OPT_IN environment variable,
+// "messaging" selects [SemconvStabilityNew] and "messaging/dup" selects [SemconvStabilityDup],
+// otherwise it is [SemconvStabilityOld].
+func WithSemconvStability(stability SemconvStability) Option {
+	return func(cfg *config) {
+		cfg.SemconvStability = stability
+	}
+}
+
+// WithSettleSpans sets whether to trace settling deliveries, i.e. Ack, Nack and Reject, with their own spans.
+// When enabled, the span of a delivery is ended by [EndDelivery] when the consumer has done processing it,
+// and settling it starts a short settle span linked to it.
+// If the consumer doesn't call [EndDelivery], the span of the delivery ends when it is settled.
+func WithSettleSpans(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.SettleSpans = enabled
+	}
+}
+
+// WithDeliveryBufferSize sets how many deliveries returned by [Channel.Consume] and [Channel.ConsumeWithContext]
+// are buffered, which lets the instrumentation receive deliveries ahead of the consumer
+// instead of waiting for each handoff.
+// By default, or if size is negative, the buffer size is the prefetch count last set by [Channel.Qos],
+// so it is unbuffered unless Qos is set.
+//
+// Consume returns a buffered channel, and a delivery consumed with autoAck is handed off
+// when it enters the buffer, see [AutoAckSpanEndOnHandoff].
+// ConsumeWithContext returns an unbuffered channel and buffers deliveries internally,
+// so the buffered deliveries are cancelled when the context is done, and a delivery is handed off
+// when the consumer receives it.
+func WithDeliveryBufferSize(size int) Option {
+	return func(cfg *config) {
+		cfg.DeliveryBufferSize = size
+	}
+}
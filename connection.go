@@ -0,0 +1,107 @@
+package amqp091otel
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// Connection wraps an [amqp091.Connection] with OpenTelemetry instrumentation.
+// Channels opened via [Connection.Channel] are instrumented with the options of the Connection.
+type Connection struct {
+	*amqp091.Connection
+	uri amqp091.URI
+	cfg *config
+}
+
+// NewConnection returns an [amqp091.Connection] with OpenTelemetry instrumentation.
+// url must be the AMQP URI that was used to open amqpConn.
+func NewConnection(amqpConn *amqp091.Connection, url string, opts ...Option) (*Connection, error) {
+	uri, err := parseURI(url)
+	if err != nil {
+		return nil, err
+	}
+	return &Connection{
+		Connection: amqpConn,
+		uri:        uri,
+		cfg:        newConfig(opts),
+	}, nil
+}
+
+// Dial is the instrumented version of [amqp091.Dial].
+func Dial(url string, opts ...Option) (*Connection, error) {
+	var config amqp091.Config
+	return DialConfig(url, config, opts...)
+}
+
+// DialTLS is the instrumented version of [amqp091.DialTLS].
+func DialTLS(url string, amqps *tls.Config, opts ...Option) (*Connection, error) {
+	var config amqp091.Config
+	config.TLSClientConfig = amqps
+	return DialConfig(url, config, opts...)
+}
+
+// DialConfig is the instrumented version of [amqp091.DialConfig].
+func DialConfig(url string, config amqp091.Config, opts ...Option) (*Connection, error) {
+	amqpConn, err := amqp091.DialConfig(url, config)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := NewConnection(amqpConn, url, opts...)
+	if err != nil {
+		_ = amqpConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Channel opens a unique, concurrent server channel, and returns it with OpenTelemetry instrumentation.
+// See [amqp091.Connection.Channel] for details.
+func (c *Connection) Channel() (*Channel, error) {
+	amqpChan, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return newChannel(amqpChan, c.Connection, c.uri, c.cfg), nil
+}
+
+// netAttrs returns the attributes of the network connection between remote, the broker node, and local.
+// Addresses that are unknown, e.g. the underlying transport is not a [net.Conn], are omitted.
+func netAttrs(remote, local net.Addr) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if host, port, ok := splitAddr(remote); ok {
+		attrs = append(attrs, semconv.NetworkPeerAddress(host), semconv.NetworkPeerPort(port))
+		if ip := net.ParseIP(host); ip != nil {
+			if ip.To4() != nil {
+				attrs = append(attrs, semconv.NetworkTypeIPv4)
+			} else {
+				attrs = append(attrs, semconv.NetworkTypeIPv6)
+			}
+		}
+	}
+	if host, _, ok := splitAddr(local); ok {
+		// The local port is left out, as it changes on every reconnection.
+		attrs = append(attrs, semconv.NetworkLocalAddress(host))
+	}
+	return attrs
+}
+
+func splitAddr(addr net.Addr) (host string, port int, ok bool) {
+	if addr == nil {
+		return "", 0, false
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil || host == "" {
+		return "", 0, false
+	}
+	port, err = strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, false
+	}
+	return host, port, true
+}
@@ -0,0 +1,186 @@
+package amqp091otel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// ErrHandlerPanic is wrapped by the error recorded when a [Handler] panics.
+var ErrHandlerPanic = errors.New("amqp091otel: handler panicked")
+
+// Handler processes a delivery consumed by [Channel.ConsumeFunc].
+// ctx is derived from the context passed to ConsumeFunc without its cancellation,
+// so deliveries already received are handled to the end after ConsumeFunc is cancelled.
+// It carries the values of that context, and the span and the baggage of the delivery.
+// The delivery must not be settled by the handler, it is settled according to the [SettlePolicy] after it returns.
+type Handler func(ctx context.Context, msg amqp091.Delivery) error
+
+// Settlement is how a delivery is settled after it is handled.
+type Settlement int
+
+const (
+	// SettlementAck acknowledges the delivery.
+	SettlementAck Settlement = iota
+	// SettlementRequeue negatively acknowledges the delivery, and requeues it.
+	SettlementRequeue
+	// SettlementDiscard negatively acknowledges the delivery without requeueing it,
+	// so it is dead-lettered if the queue is configured to.
+	SettlementDiscard
+)
+
+// SettlePolicy decides how a delivery is settled from the error returned by the [Handler].
+// If the handler panics, err wraps [ErrHandlerPanic].
+type SettlePolicy func(msg amqp091.Delivery, err error) Settlement
+
+// DefaultSettlePolicy acknowledges the delivery if the handler succeeds.
+// Otherwise, the delivery is requeued on its first failure, and discarded if it fails again after redelivery.
+func DefaultSettlePolicy(msg amqp091.Delivery, err error) Settlement {
+	switch {
+	case err == nil:
+		return SettlementAck
+	case msg.Redelivered:
+		return SettlementDiscard
+	default:
+		return SettlementRequeue
+	}
+}
+
+// ConsumeOptions are the options of [Channel.ConsumeFunc].
+// See [amqp091.Channel.Consume] for the fields other than SettlePolicy and Workers.
+type ConsumeOptions struct {
+	Consumer  string
+	AutoAck   bool
+	Exclusive bool
+	NoLocal   bool
+	NoWait    bool
+	Args      amqp091.Table
+	// SettlePolicy decides how a delivery is settled after it is handled, ignored when AutoAck is true.
+	// If it is nil, DefaultSettlePolicy is used.
+	SettlePolicy SettlePolicy
+	// Workers is the number of handlers that run in parallel, 1 if it is not positive.
+	// If it is positive and AutoAck is false, the prefetch count of the channel is set to Workers,
+	// so the broker doesn't send more deliveries than the workers can take.
+	Workers int
+}
+
+// ConsumeFunc consumes deliveries from queue and calls handler for each of them,
+// until ctx is done or the channel is closed.
+//
+// The span of each delivery starts before handler is called. When handler returns, the delivery is settled
+// according to opts.SettlePolicy, and the span ends with the outcome of settling,
+// or with an error status if handler returns an error or panics.
+// With [WithSettleSpans], the span ends when handler returns, before settling starts its own span.
+// A panic is recovered, and doesn't stop consuming.
+//
+// When ctx is done, the consumer is cancelled on the broker,
+// and ConsumeFunc returns ctx.Err() after handling deliveries already received.
+// When the channel is closed, it returns [amqp091.ErrClosed].
+//
+// With opts.Workers greater than 1, deliveries may be handled and settled out of order.
+// How long each delivery waits for a free worker is recorded on its span.
+func (ch *Channel) ConsumeFunc(ctx context.Context, queue string, opts ConsumeOptions, handler Handler) error {
+	if opts.Workers > 0 && !opts.AutoAck {
+		if err := ch.Qos(opts.Workers, 0, false); err != nil {
+			return err
+		}
+	}
+	deliveries, err := ch.Channel.ConsumeWithContext(ctx,
+		queue, opts.Consumer, opts.AutoAck, opts.Exclusive, opts.NoLocal, opts.NoWait, opts.Args)
+	if err != nil {
+		return err
+	}
+	ch.consume(ctx, deliveries, queue, opts, handler)
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return amqp091.ErrClosed
+}
+
+// consumeJob is a delivery received by consume, waiting for a worker to handle it.
+type consumeJob struct {
+	msg amqp091.Delivery
+	ack *acknowledger
+}
+
+// consume starts the span of each delivery once it is received, and hands it to opts.Workers workers,
+// until deliveries is closed and all received deliveries are handled.
+// Handlers are called with contexts derived from ctx, see Handler.
+func (ch *Channel) consume(
+	ctx context.Context, deliveries <-chan amqp091.Delivery, queue string, opts ConsumeOptions, handler Handler,
+) {
+	ctx = context.WithoutCancel(ctx)
+	workers := max(opts.Workers, 1)
+	jobs := make(chan consumeJob, workers)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for job := range jobs {
+				handle(ctx, &job.msg, job.ack, opts, handler)
+			}
+		})
+	}
+	for msg := range deliveries {
+		ack := ch.startConsumerSpan(&msg, queue, operationDeliver, opts.AutoAck)
+		jobs <- consumeJob{msg: msg, ack: ack}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// handle calls handler with msg and settles it, which ends the span of msg.
+func handle(ctx context.Context, msg *amqp091.Delivery, ack *acknowledger, opts ConsumeOptions, handler Handler) {
+	ack.span.SetAttributes(handlerWaitDurationKey.Float64(time.Since(ack.start).Seconds()))
+	err := callHandler(handlerContext(ctx, ack), *msg, handler)
+	if opts.AutoAck {
+		ack.endAutoAck(err)
+		return
+	}
+	if err != nil {
+		ack.setHandlerErr(err)
+	}
+	if ack.ch.cfg.SettleSpans {
+		// Settling is traced by its own span, which starts after the span of msg ends.
+		ack.endDelivery(err)
+	}
+
+	policy := opts.SettlePolicy
+	if policy == nil {
+		policy = DefaultSettlePolicy
+	}
+	// Without settle spans, settling ends the span with the error of handler if any,
+	// and records the outcome and the error of settling on it.
+	// With settle spans, they are recorded on the settle span instead, see WithSettleSpans.
+	// Errors of settling mean the channel is closed, which stops consuming anyway.
+	switch policy(*msg, err) {
+	case SettlementRequeue:
+		_ = msg.Nack(false, true)
+	case SettlementDiscard:
+		_ = msg.Nack(false, false)
+	default:
+		_ = msg.Ack(false)
+	}
+}
+
+// handlerContext returns ctx with the span and the baggage of the delivery of ack.
+func handlerContext(ctx context.Context, ack *acknowledger) context.Context {
+	ctx = baggage.ContextWithBaggage(ctx, baggage.FromContext(ack.ctx))
+	return trace.ContextWithSpan(ctx, ack.span)
+}
+
+// callHandler calls handler, and converts a panic in it to an error.
+func callHandler(ctx context.Context, msg amqp091.Delivery, handler Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrHandlerPanic, r)
+		}
+	}()
+	return handler(ctx, msg)
+}
@@ -0,0 +1,274 @@
+package amqp091otel
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/rabbitmq/amqp091-go"
+
+	"github.com/wzy9607/amqp091otel/internal/mocks/amqp091"
+)
+
+func TestDefaultSettlePolicy(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		msg amqp091.Delivery
+		err error
+	}
+	tests := []struct {
+		name string
+		args args
+		want Settlement
+	}{
+		{
+			name: "success",
+			args: args{msg: amqp091.Delivery{}},
+			want: SettlementAck,
+		}, {
+			name: "first failure",
+			args: args{msg: amqp091.Delivery{}, err: errors.New("some error")},
+			want: SettlementRequeue,
+		}, {
+			name: "failure after redelivery",
+			args: args{msg: amqp091.Delivery{Redelivered: true}, err: errors.New("some error")},
+			want: SettlementDiscard,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.want, DefaultSettlePolicy(tt.args.msg, tt.args.err))
+		})
+	}
+}
+
+func TestChannel_consume(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		opts    ConsumeOptions
+		handler Handler
+	}
+	tests := []struct {
+		name       string
+		args       args
+		setupMock  func(acker *mockamqp091.MockAcknowledger)
+		wantStatus codes.Code
+		wantEvents int
+		wantPanic  bool
+	}{
+		{
+			name: "ack on success",
+			args: args{handler: func(context.Context, amqp091.Delivery) error { return nil }},
+			setupMock: func(acker *mockamqp091.MockAcknowledger) {
+				acker.EXPECT().Ack(uint64(1), false).Return(nil)
+			},
+			wantStatus: codes.Ok,
+		}, {
+			name: "record settle error",
+			args: args{handler: func(context.Context, amqp091.Delivery) error { return nil }},
+			setupMock: func(acker *mockamqp091.MockAcknowledger) {
+				acker.EXPECT().Ack(uint64(1), false).Return(amqp091.ErrClosed)
+			},
+			wantStatus: codes.Ok,
+			wantEvents: 1,
+		}, {
+			name: "requeue on error",
+			args: args{handler: func(context.Context, amqp091.Delivery) error { return errors.New("some error") }},
+			setupMock: func(acker *mockamqp091.MockAcknowledger) {
+				acker.EXPECT().Nack(uint64(1), false, true).Return(nil)
+			},
+			wantStatus: codes.Error,
+			wantEvents: 1,
+		}, {
+			name: "record handler and settle errors",
+			args: args{handler: func(context.Context, amqp091.Delivery) error { return errors.New("some error") }},
+			setupMock: func(acker *mockamqp091.MockAcknowledger) {
+				acker.EXPECT().Nack(uint64(1), false, true).Return(amqp091.ErrClosed)
+			},
+			wantStatus: codes.Error,
+			wantEvents: 2,
+		}, {
+			name: "recover panic",
+			args: args{handler: func(context.Context, amqp091.Delivery) error { panic("boom") }},
+			setupMock: func(acker *mockamqp091.MockAcknowledger) {
+				acker.EXPECT().Nack(uint64(1), false, true).Return(nil)
+			},
+			wantStatus: codes.Error,
+			wantEvents: 1,
+			wantPanic:  true,
+		}, {
+			name: "custom settle policy",
+			args: args{
+				opts: ConsumeOptions{
+					SettlePolicy: func(amqp091.Delivery, error) Settlement { return SettlementDiscard },
+				},
+				handler: func(context.Context, amqp091.Delivery) error { return errors.New("some error") },
+			},
+			setupMock: func(acker *mockamqp091.MockAcknowledger) {
+				acker.EXPECT().Nack(uint64(1), false, false).Return(nil)
+			},
+			wantStatus: codes.Error,
+			wantEvents: 1,
+		}, {
+			name: "error status when acked on error",
+			args: args{
+				opts: ConsumeOptions{
+					SettlePolicy: func(amqp091.Delivery, error) Settlement { return SettlementAck },
+				},
+				handler: func(context.Context, amqp091.Delivery) error { return errors.New("some error") },
+			},
+			setupMock: func(acker *mockamqp091.MockAcknowledger) {
+				acker.EXPECT().Ack(uint64(1), false).Return(nil)
+			},
+			wantStatus: codes.Error,
+			wantEvents: 1,
+		}, {
+			name: "autoAck is not settled",
+			args: args{
+				opts:    ConsumeOptions{AutoAck: true},
+				handler: func(context.Context, amqp091.Delivery) error { return errors.New("some error") },
+			},
+			setupMock:  func(*mockamqp091.MockAcknowledger) {},
+			wantStatus: codes.Error,
+			wantEvents: 1,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp, exp := initMockTracerProvider()
+			ch := newTestChannel(t, WithTracerProvider(tp))
+			acker := mockamqp091.NewMockAcknowledger(t)
+			tt.setupMock(acker)
+			deliveries := make(chan amqp091.Delivery, 1)
+			deliveries <- amqp091.Delivery{Acknowledger: acker, DeliveryTag: 1}
+			close(deliveries)
+			var handlerSpan trace.SpanContext
+			handler := func(ctx context.Context, msg amqp091.Delivery) error {
+				handlerSpan = trace.SpanContextFromContext(ctx)
+				return tt.args.handler(ctx, msg)
+			}
+
+			ch.consume(context.Background(), deliveries, "queue", tt.args.opts, handler)
+
+			spans := exp.GetSpans()
+			require.Len(t, spans, 1)
+			assert.Equal(t, spans[0].SpanContext, handlerSpan, "handler should get the context of the span")
+			assert.Equal(t, tt.wantStatus, spans[0].Status.Code)
+			assert.Len(t, spans[0].Events, tt.wantEvents)
+			if tt.wantPanic {
+				assert.Contains(t, spans[0].Status.Description, ErrHandlerPanic.Error())
+			}
+			assert.Empty(t, ch.spanMap)
+		})
+	}
+}
+
+func TestChannel_consume_workers(t *testing.T) {
+	t.Parallel()
+	const workers = 3
+	tp, exp := initMockTracerProvider()
+	ch := newTestChannel(t, WithTracerProvider(tp))
+	acker := mockamqp091.NewMockAcknowledger(t)
+	deliveries := make(chan amqp091.Delivery, workers)
+	for tag := uint64(1); tag <= workers; tag++ {
+		acker.EXPECT().Ack(tag, false).Return(nil)
+		deliveries <- amqp091.Delivery{Acknowledger: acker, DeliveryTag: tag}
+	}
+	close(deliveries)
+
+	// Every handler waits until all of them have started, so they must run in parallel,
+	// and the deliveries are acked in whatever order the handlers return.
+	var started sync.WaitGroup
+	started.Add(workers)
+	handler := func(context.Context, amqp091.Delivery) error {
+		started.Done()
+		started.Wait()
+		return nil
+	}
+	ch.consume(context.Background(), deliveries, "queue", ConsumeOptions{Workers: workers}, handler)
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, workers)
+	for _, span := range spans {
+		assert.False(t, span.EndTime.IsZero())
+		assert.True(t, slices.ContainsFunc(span.Attributes, func(kv attribute.KeyValue) bool {
+			return kv.Key == handlerWaitDurationKey
+		}))
+	}
+	assert.Empty(t, ch.spanMap)
+}
+
+func TestChannel_consume_handlerContext(t *testing.T) {
+	t.Parallel()
+	tp, _ := initMockTracerProvider()
+	ch := newTestChannel(t, WithTracerProvider(tp), WithPropagators(propagation.Baggage{}))
+	acker := mockamqp091.NewMockAcknowledger(t)
+	acker.EXPECT().Ack(uint64(1), false).Return(nil)
+	member, err := baggage.NewMember("tenant", "a")
+	require.NoError(t, err)
+	bag, err := baggage.New(member)
+	require.NoError(t, err)
+	msg := amqp091.Delivery{Acknowledger: acker, DeliveryTag: 1, Headers: amqp091.Table{}}
+	ch.cfg.Propagators.Inject(baggage.ContextWithBaggage(context.Background(), bag),
+		newDeliveryMessageCarrier(&msg, ch.cfg.HeaderLayout))
+	deliveries := make(chan amqp091.Delivery, 1)
+	deliveries <- msg
+	close(deliveries)
+	type ctxKey struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "value"))
+	// Deliveries already received are handled after ConsumeFunc is cancelled.
+	cancel()
+
+	var handlerCtx, deliveryCtx context.Context
+	ch.consume(ctx, deliveries, "queue", ConsumeOptions{}, func(ctx context.Context, msg amqp091.Delivery) error {
+		handlerCtx, deliveryCtx = ctx, ContextFromDelivery(msg)
+		return nil
+	})
+
+	require.NotNil(t, handlerCtx)
+	assert.Equal(t, "value", handlerCtx.Value(ctxKey{}), "handler should get the values of the caller")
+	require.NoError(t, handlerCtx.Err(), "handler should not be cancelled with the caller")
+	assert.Equal(t, "a", baggage.FromContext(handlerCtx).Member("tenant").Value())
+	assert.Equal(t, trace.SpanContextFromContext(deliveryCtx), trace.SpanContextFromContext(handlerCtx),
+		"handler should get the span of the delivery")
+}
+
+func TestChannel_consume_settleSpans(t *testing.T) {
+	t.Parallel()
+	tp, exp := initMockTracerProvider()
+	ch := newTestChannel(t, WithTracerProvider(tp), WithSettleSpans(true))
+	acker := mockamqp091.NewMockAcknowledger(t)
+	acker.EXPECT().Nack(uint64(1), false, true).Return(nil)
+	deliveries := make(chan amqp091.Delivery, 1)
+	deliveries <- amqp091.Delivery{Acknowledger: acker, DeliveryTag: 1}
+	close(deliveries)
+
+	ch.consume(context.Background(), deliveries, "queue", ConsumeOptions{},
+		func(context.Context, amqp091.Delivery) error { return errors.New("some error") })
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 2)
+	processSpan, settleSpan := spans[0], spans[1]
+	assert.Equal(t, trace.SpanKindConsumer, processSpan.SpanKind)
+	assert.Equal(t, trace.SpanKindClient, settleSpan.SpanKind)
+	assert.False(t, processSpan.EndTime.After(settleSpan.StartTime),
+		"process span should end before the settle span starts")
+	assert.Equal(t, codes.Error, processSpan.Status.Code)
+	require.Len(t, settleSpan.Links, 1)
+	assert.Equal(t, processSpan.SpanContext.SpanID(), settleSpan.Links[0].SpanContext.SpanID())
+	assert.Empty(t, ch.spanMap)
+}
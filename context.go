@@ -10,7 +10,7 @@ import (
 // If the delivery does not contain traces, it returns a background context.
 // Consumer can use this function to continue the distributed tracing.
 func ContextFromDelivery(msg amqp091.Delivery) context.Context {
-	if ack, ok := msg.Acknowledger.(*acknowledger); ok {
+	if ack, ok := acknowledgerOf(msg); ok {
 		return ack.ctx
 	}
 	return context.Background()
@@ -0,0 +1,82 @@
+package amqp091otel
+
+import (
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// replyCodeNames are the names of the AMQP 0-9-1 reply codes of errors.
+var replyCodeNames = map[int]string{
+	amqp091.ContentTooLarge:    "CONTENT_TOO_LARGE",
+	amqp091.NoRoute:            "NO_ROUTE",
+	amqp091.NoConsumers:        "NO_CONSUMERS",
+	amqp091.ConnectionForced:   "CONNECTION_FORCED",
+	amqp091.InvalidPath:        "INVALID_PATH",
+	amqp091.AccessRefused:      "ACCESS_REFUSED",
+	amqp091.NotFound:           "NOT_FOUND",
+	amqp091.ResourceLocked:     "RESOURCE_LOCKED",
+	amqp091.PreconditionFailed: "PRECONDITION_FAILED",
+	amqp091.FrameError:         "FRAME_ERROR",
+	amqp091.SyntaxError:        "SYNTAX_ERROR",
+	amqp091.CommandInvalid:     "COMMAND_INVALID",
+	amqp091.ChannelError:       "CHANNEL_ERROR",
+	amqp091.UnexpectedFrame:    "UNEXPECTED_FRAME",
+	amqp091.ResourceError:      "RESOURCE_ERROR",
+	amqp091.NotAllowed:         "NOT_ALLOWED",
+	amqp091.NotImplemented:     "NOT_IMPLEMENTED",
+	amqp091.InternalError:      "INTERNAL_ERROR",
+}
+
+// replyCodeName returns the name of the AMQP 0-9-1 reply code, or the code itself if it is unknown.
+func replyCodeName(code int) string {
+	if name, ok := replyCodeNames[code]; ok {
+		return name
+	}
+	return fmt.Sprint(code)
+}
+
+// channelException reports whether the reply code is of a channel exception (a.k.a. soft error),
+// which closes only the channel, rather than a connection exception, which closes the connection.
+func channelException(code int) bool {
+	switch code {
+	case amqp091.ContentTooLarge, amqp091.NoRoute, amqp091.NoConsumers,
+		amqp091.AccessRefused, amqp091.NotFound, amqp091.ResourceLocked, amqp091.PreconditionFailed:
+		return true
+	default:
+		return false
+	}
+}
+
+// errorType returns the error.type attribute of err, which must not be nil.
+// For an [amqp091.Error], it is the name of the reply code, e.g. NOT_FOUND,
+// otherwise it is the type of err.
+func errorType(err error) attribute.KeyValue {
+	var amqpErr *amqp091.Error
+	if errors.As(err, &amqpErr) {
+		return semconv.ErrorTypeKey.String(replyCodeName(amqpErr.Code))
+	}
+	return semconv.ErrorTypeKey.String(fmt.Sprintf("%T", err))
+}
+
+// errorAttrs returns the attributes describing err on spans, err must not be nil.
+func errorAttrs(err error) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{errorType(err)}
+	var amqpErr *amqp091.Error
+	if errors.As(err, &amqpErr) {
+		exception := "connection"
+		if channelException(amqpErr.Code) {
+			exception = "channel"
+		}
+		attrs = append(attrs,
+			errorCodeKey.Int(amqpErr.Code),
+			errorExceptionKey.String(exception),
+			errorRecoverableKey.Bool(amqpErr.Recover),
+		)
+	}
+	return attrs
+}
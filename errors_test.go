@@ -0,0 +1,74 @@
+package amqp091otel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func Test_errorAttrs(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		err error
+	}
+	tests := []struct {
+		name string
+		args args
+		want []attribute.KeyValue
+	}{
+		{
+			name: "channel exception",
+			args: args{err: &amqp091.Error{Code: amqp091.NotFound, Reason: "NOT_FOUND - no queue", Recover: true}},
+			want: []attribute.KeyValue{
+				semconv.ErrorTypeKey.String("NOT_FOUND"),
+				errorCodeKey.Int(amqp091.NotFound),
+				errorExceptionKey.String("channel"),
+				errorRecoverableKey.Bool(true),
+			},
+		}, {
+			name: "wrapped connection exception",
+			args: args{err: fmt.Errorf("wrapped: %w", &amqp091.Error{Code: amqp091.ConnectionForced})},
+			want: []attribute.KeyValue{
+				semconv.ErrorTypeKey.String("CONNECTION_FORCED"),
+				errorCodeKey.Int(amqp091.ConnectionForced),
+				errorExceptionKey.String("connection"),
+				errorRecoverableKey.Bool(false),
+			},
+		}, {
+			name: "unknown code",
+			args: args{err: &amqp091.Error{Code: 999}},
+			want: []attribute.KeyValue{
+				semconv.ErrorTypeKey.String("999"),
+				errorCodeKey.Int(999),
+				errorExceptionKey.String("connection"),
+				errorRecoverableKey.Bool(false),
+			},
+		}, {
+			name: "other error",
+			args: args{err: context.DeadlineExceeded},
+			want: []attribute.KeyValue{
+				semconv.ErrorTypeKey.String("context.deadlineExceededError"),
+			},
+		}, {
+			name: "plain error",
+			args: args{err: errors.New("some error")},
+			want: []attribute.KeyValue{
+				semconv.ErrorTypeKey.String("*errors.errorString"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.want, errorAttrs(tt.args.err))
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package amqp091otel
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// https://opentelemetry.io/docs/specs/semconv/messaging/messaging-metrics/
+// The names follow the current conventions regardless of SemconvStability.
+const (
+	clientSentMessagesName        = "messaging.client.sent.messages"
+	clientSentMessagesUnit        = "{message}"
+	clientSentMessagesDescription = "Number of messages producer attempted to send to the broker."
+
+	clientOperationDurationName        = "messaging.client.operation.duration"
+	clientOperationDurationUnit        = "s"
+	clientOperationDurationDescription = "Duration of messaging operation initiated by a producer or consumer client."
+
+	clientConsumedMessagesName        = "messaging.client.consumed.messages"
+	clientConsumedMessagesUnit        = "{message}"
+	clientConsumedMessagesDescription = "Number of messages that were delivered to the application."
+
+	processDurationName        = "messaging.process.duration"
+	processDurationUnit        = "s"
+	processDurationDescription = "Duration of processing operation."
+)
+
+// durationBuckets are the bucket boundaries recommended by the messaging semantic conventions.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10}
+
+// metrics holds the instruments used by the instrumentation.
+type metrics struct {
+	clientSentMessages      metric.Int64Counter
+	clientOperationDuration metric.Float64Histogram
+	clientConsumedMessages  metric.Int64Counter
+	processDuration         metric.Float64Histogram
+}
+
+func newMetrics(meter metric.Meter) *metrics {
+	clientSentMessages, err := meter.Int64Counter(clientSentMessagesName,
+		metric.WithUnit(clientSentMessagesUnit),
+		metric.WithDescription(clientSentMessagesDescription),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	clientOperationDuration, err := meter.Float64Histogram(clientOperationDurationName,
+		metric.WithUnit(clientOperationDurationUnit),
+		metric.WithDescription(clientOperationDurationDescription),
+		metric.WithExplicitBucketBoundaries(durationBuckets...),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	clientConsumedMessages, err := meter.Int64Counter(clientConsumedMessagesName,
+		metric.WithUnit(clientConsumedMessagesUnit),
+		metric.WithDescription(clientConsumedMessagesDescription),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	processDuration, err := meter.Float64Histogram(processDurationName,
+		metric.WithUnit(processDurationUnit),
+		metric.WithDescription(processDurationDescription),
+		metric.WithExplicitBucketBoundaries(durationBuckets...),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	return &metrics{
+		clientSentMessages:      clientSentMessages,
+		clientOperationDuration: clientOperationDuration,
+		clientConsumedMessages:  clientConsumedMessages,
+		processDuration:         processDuration,
+	}
+}
+
+// recordPublish records the metrics of a publish operation started at start.
+func (m *metrics) recordPublish(ctx context.Context, start time.Time, attrs []attribute.KeyValue, err error) {
+	if err != nil {
+		attrs = append(attrs, errorType(err))
+	}
+	opt := metric.WithAttributeSet(attribute.NewSet(attrs...))
+	m.clientSentMessages.Add(ctx, 1, opt)
+	m.clientOperationDuration.Record(ctx, time.Since(start).Seconds(), opt)
+}
+
+// recordConsume records the metrics of count deliveries received by Consume or Get.
+func (m *metrics) recordConsume(ctx context.Context, count int64, attrs []attribute.KeyValue) {
+	m.clientConsumedMessages.Add(ctx, count, metric.WithAttributeSet(attribute.NewSet(attrs...)))
+}
+
+// recordProcess records the metrics of processing a delivery received at start, which is settled just now.
+func (m *metrics) recordProcess(ctx context.Context, start time.Time, attrs []attribute.KeyValue, err error) {
+	if err != nil {
+		attrs = append(attrs, errorType(err))
+	}
+	m.processDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributeSet(attribute.NewSet(attrs...)))
+}
@@ -0,0 +1,135 @@
+package amqp091otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	metricsdk "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func initMockMeterProvider() (*metricsdk.MeterProvider, *metricsdk.ManualReader) {
+	reader := metricsdk.NewManualReader()
+	mp := metricsdk.NewMeterProvider(metricsdk.WithReader(reader))
+	return mp, reader
+}
+
+func collectMetrics(t *testing.T, reader *metricsdk.ManualReader) map[string]metricdata.Metrics {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	out := map[string]metricdata.Metrics{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			out[m.Name] = m
+		}
+	}
+	return out
+}
+
+func Test_metrics_recordPublish(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		attrs []attribute.KeyValue
+		err   error
+	}
+	tests := []struct {
+		name      string
+		args      args
+		wantAttrs attribute.Set
+	}{
+		{
+			name: "success",
+			args: args{
+				attrs: []attribute.KeyValue{semconv.MessagingDestinationName("exchange")},
+			},
+			wantAttrs: attribute.NewSet(semconv.MessagingDestinationName("exchange")),
+		}, {
+			name: "error",
+			args: args{
+				attrs: []attribute.KeyValue{semconv.MessagingDestinationName("exchange")},
+				err:   errors.New("some error"),
+			},
+			wantAttrs: attribute.NewSet(
+				semconv.MessagingDestinationName("exchange"),
+				semconv.ErrorTypeKey.String("*errors.errorString"),
+			),
+		}, {
+			name: "amqp error",
+			args: args{
+				attrs: []attribute.KeyValue{semconv.MessagingDestinationName("exchange")},
+				err:   amqp091.ErrClosed,
+			},
+			wantAttrs: attribute.NewSet(
+				semconv.MessagingDestinationName("exchange"),
+				semconv.ErrorTypeKey.String("CHANNEL_ERROR"),
+			),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			mp, reader := initMockMeterProvider()
+			m := newMetrics(mp.Meter("test"))
+
+			m.recordPublish(context.Background(), time.Now(), tt.args.attrs, tt.args.err)
+
+			got := collectMetrics(t, reader)
+			require.Contains(t, got, clientSentMessagesName)
+			sent, ok := got[clientSentMessagesName].Data.(metricdata.Sum[int64])
+			require.True(t, ok)
+			require.Len(t, sent.DataPoints, 1)
+			assert.Equal(t, int64(1), sent.DataPoints[0].Value)
+			assert.Equal(t, tt.wantAttrs, sent.DataPoints[0].Attributes)
+
+			require.Contains(t, got, clientOperationDurationName)
+			duration, ok := got[clientOperationDurationName].Data.(metricdata.Histogram[float64])
+			require.True(t, ok)
+			require.Len(t, duration.DataPoints, 1)
+			assert.Equal(t, uint64(1), duration.DataPoints[0].Count)
+			assert.Equal(t, tt.wantAttrs, duration.DataPoints[0].Attributes)
+		})
+	}
+}
+
+// consumedMessages returns the number of messages recorded as consumed, across every attribute set.
+func consumedMessages(t *testing.T, reader *metricsdk.ManualReader) int64 {
+	t.Helper()
+	m, ok := collectMetrics(t, reader)[clientConsumedMessagesName]
+	if !ok {
+		return 0
+	}
+	consumed, ok := m.Data.(metricdata.Sum[int64])
+	require.True(t, ok)
+	var total int64
+	for _, dp := range consumed.DataPoints {
+		total += dp.Value
+	}
+	return total
+}
+
+func Test_metrics_recordConsume(t *testing.T) {
+	t.Parallel()
+	mp, reader := initMockMeterProvider()
+	m := newMetrics(mp.Meter("test"))
+
+	m.recordConsume(context.Background(), 1, []attribute.KeyValue{semconv.MessagingDestinationName("queue")})
+	m.recordConsume(context.Background(), 2, []attribute.KeyValue{semconv.MessagingDestinationName("queue")})
+
+	got := collectMetrics(t, reader)
+	require.Contains(t, got, clientConsumedMessagesName)
+	consumed, ok := got[clientConsumedMessagesName].Data.(metricdata.Sum[int64])
+	require.True(t, ok)
+	require.Len(t, consumed.DataPoints, 1)
+	assert.Equal(t, int64(3), consumed.DataPoints[0].Value)
+	assert.Equal(t, attribute.NewSet(semconv.MessagingDestinationName("queue")), consumed.DataPoints[0].Attributes)
+}
@@ -0,0 +1,64 @@
+package amqp091otel
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// NotifyReturn registers a listener for basic.return methods, see [amqp091.Channel.NotifyReturn] for details.
+// Every return is recorded as a span in the trace of the publishing it belongs to,
+// with an error status carrying the reply code and text.
+func (ch *Channel) NotifyReturn(c chan amqp091.Return) chan amqp091.Return {
+	returns := ch.Channel.NotifyReturn(make(chan amqp091.Return, cap(c)))
+	go func() {
+		for ret := range returns {
+			ch.recordReturn(&ret)
+			c <- ret
+		}
+		close(c)
+	}()
+	return c
+}
+
+func (*Channel) nameWhenReturn(exchange string) string {
+	if exchange == "" {
+		exchange = "(default)"
+	}
+	return "return " + exchange
+}
+
+// recordReturn records a span for the returned publishing,
+// as a child of the publish span extracted from the headers of the publishing.
+func (ch *Channel) recordReturn(ret *amqp091.Return) {
+	carrier := newReturnMessageCarrier(ret, ch.cfg.HeaderLayout)
+	parentCtx := ch.cfg.Propagators.Extract(context.Background(), carrier)
+
+	attrs := []attribute.KeyValue{
+		semconv.MessagingDestinationAnonymous(ret.Exchange == ""),
+		semconv.MessagingDestinationName(ret.Exchange),
+		semconv.MessagingRabbitMQDestinationRoutingKey(ret.RoutingKey),
+		returnReplyCodeKey.Int(int(ret.ReplyCode)),
+		returnReplyTextKey.String(ret.ReplyText),
+		semconv.ErrorTypeKey.String(replyCodeName(int(ret.ReplyCode))),
+	}
+	if ret.CorrelationId != "" {
+		attrs = append(attrs, semconv.MessagingMessageConversationID(ret.CorrelationId))
+	}
+	if ret.MessageId != "" {
+		attrs = append(attrs, semconv.MessagingMessageID(ret.MessageId))
+	}
+	attrs = append(attrs, ch.commonAttrs()...)
+	opts := []trace.SpanStartOption{
+		trace.WithAttributes(attrs...),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+	}
+	_, span := ch.cfg.Tracer.Start(parentCtx, ch.nameWhenReturn(ret.Exchange), opts...)
+	span.SetStatus(codes.Error, ret.ReplyText)
+	span.End()
+}
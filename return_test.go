@@ -0,0 +1,41 @@
+package amqp091otel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestChannel_recordReturn(t *testing.T) {
+	t.Parallel()
+	tp, exp := initMockTracerProvider()
+	ch := newTestChannel(t, WithTracerProvider(tp), WithPropagators(propagation.TraceContext{}))
+
+	ctx, publishSpan := tp.Tracer("test").Start(context.Background(), "publish")
+	ret := amqp091.Return{
+		ReplyCode:  amqp091.NoRoute,
+		ReplyText:  "NO_ROUTE",
+		Exchange:   "exchange",
+		RoutingKey: "key",
+		Headers:    amqp091.Table{},
+	}
+	ch.cfg.Propagators.Inject(ctx, newReturnMessageCarrier(&ret, ch.cfg.HeaderLayout))
+	publishSpan.End()
+
+	ch.recordReturn(&ret)
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 2)
+	span := spans[1]
+	assert.Equal(t, "return exchange", span.Name)
+	assert.Equal(t, publishSpan.SpanContext().SpanID(), span.Parent.SpanID())
+	assert.Equal(t, codes.Error, span.Status.Code)
+	assert.Equal(t, "NO_ROUTE", span.Status.Description)
+	assert.Contains(t, span.Attributes, returnReplyCodeKey.Int(amqp091.NoRoute))
+}
@@ -0,0 +1,116 @@
+package amqp091otel
+
+import (
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv126 "go.opentelemetry.io/otel/semconv/v1.26.0"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+)
+
+// semconvStabilityOptInEnv is the environment variable to opt in to the current messaging semantic conventions.
+const semconvStabilityOptInEnv = "OTEL_SEMCONV_STABILITY_OPT_IN"
+
+// SemconvStability selects the version of the messaging semantic conventions that spans and the attributes
+// of metrics follow. The names of metrics always follow the current conventions.
+type SemconvStability int
+
+const (
+	// SemconvStabilityOld follows the messaging semantic conventions v1.26.0, which is the default.
+	SemconvStabilityOld SemconvStability = iota
+	// SemconvStabilityNew follows the current messaging semantic conventions.
+	SemconvStabilityNew
+	// SemconvStabilityDup follows both the v1.26.0 and the current messaging semantic conventions.
+	// When an attribute is defined by both with different values, e.g. messaging.operation.type,
+	// the value of the current conventions is used.
+	SemconvStabilityDup
+)
+
+// semconvStabilityFromEnv returns the SemconvStability opted in by OTEL_SEMCONV_STABILITY_OPT_IN,
+// which is a comma-separated list that may contain "messaging" or "messaging/dup".
+func semconvStabilityFromEnv() SemconvStability {
+	stability := SemconvStabilityOld
+	for _, val := range strings.Split(os.Getenv(semconvStabilityOptInEnv), ",") {
+		switch strings.TrimSpace(val) {
+		case "messaging/dup":
+			return SemconvStabilityDup
+		case "messaging":
+			stability = SemconvStabilityNew
+		}
+	}
+	return stability
+}
+
+func (s SemconvStability) emitOld() bool {
+	return s == SemconvStabilityOld || s == SemconvStabilityDup
+}
+
+func (s SemconvStability) emitNew() bool {
+	return s == SemconvStabilityNew || s == SemconvStabilityDup
+}
+
+// operation is a messaging operation performed by the instrumentation.
+type operation int
+
+const (
+	// operationPublish is publishing a message, by Publish*.
+	operationPublish operation = iota
+	// operationDeliver is processing a message pushed by the broker, by Consume.
+	operationDeliver
+	// operationReceive is processing a message pulled from the broker, by Get.
+	// Its span lasts until the message is settled, so the current conventions model it as process,
+	// not as receive, which is a CLIENT span that covers only the pull.
+	operationReceive
+	// operationCreate is creating a message that is published in a batch, by PublishBatch.
+	operationCreate
+)
+
+// operationType returns the messaging.operation.type attribute of op.
+func (s SemconvStability) operationType(op operation) attribute.KeyValue {
+	if s.emitNew() {
+		switch op {
+		case operationPublish:
+			return semconv.MessagingOperationTypeSend
+		case operationDeliver, operationReceive:
+			return semconv.MessagingOperationTypeProcess
+		case operationCreate:
+			return semconv.MessagingOperationTypeCreate
+		}
+	}
+	switch op {
+	case operationPublish:
+		return semconv126.MessagingOperationTypePublish
+	case operationDeliver:
+		return semconv126.MessagingOperationTypeDeliver
+	case operationCreate:
+		return semconv126.MessagingOperationTypeCreate
+	default:
+		return semconv126.MessagingOperationTypeReceive
+	}
+}
+
+// operationName returns the messaging.operation.name of op, which is also the first part of span names.
+// It is the same under every SemconvStability.
+func (SemconvStability) operationName(op operation) string {
+	switch op {
+	case operationPublish:
+		return "publish"
+	case operationCreate:
+		return "create"
+	default:
+		return "process"
+	}
+}
+
+// publishDestinationAttrs returns the attributes of the exchange that a delivery was published to,
+// which are only defined by the v1.26.0 conventions.
+func (s SemconvStability) publishDestinationAttrs(exchange string) []attribute.KeyValue {
+	if !s.emitOld() {
+		return nil
+	}
+	return []attribute.KeyValue{
+		semconv126.MessagingDestinationPublishAnonymous(exchange == ""),
+		semconv126.MessagingDestinationPublishName(exchange),
+	}
+}
@@ -0,0 +1,169 @@
+package amqp091otel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	semconv126 "go.opentelemetry.io/otel/semconv/v1.26.0"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+
+	"github.com/rabbitmq/amqp091-go"
+
+	"github.com/wzy9607/amqp091otel/internal/mocks/amqp091"
+)
+
+func Test_semconvStabilityFromEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		want SemconvStability
+	}{
+		{name: "unset", env: "", want: SemconvStabilityOld},
+		{name: "other signal", env: "http", want: SemconvStabilityOld},
+		{name: "new", env: "http, messaging", want: SemconvStabilityNew},
+		{name: "dup", env: "messaging/dup,http", want: SemconvStabilityDup},
+		{name: "dup wins", env: "messaging,messaging/dup", want: SemconvStabilityDup},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(semconvStabilityOptInEnv, tt.env)
+			assert.Equal(t, tt.want, semconvStabilityFromEnv())
+		})
+	}
+}
+
+func TestChannel_startConsumerSpan_semconvStability(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		stability SemconvStability
+		op        operation
+		// settle is how the delivery is settled, empty to consume it with autoAck and end it by EndDelivery.
+		settle string
+	}
+	tests := []struct {
+		name              string
+		args              args
+		wantName          string
+		wantOperationType attribute.KeyValue
+		wantOperationName string
+		wantOutcome       bool
+		wantPublishAttrs  bool
+	}{
+		{
+			name:              "old deliver",
+			args:              args{stability: SemconvStabilityOld, op: operationDeliver},
+			wantName:          "process queue",
+			wantOperationType: semconv126.MessagingOperationTypeDeliver,
+			wantOperationName: "ack",
+			wantPublishAttrs:  true,
+		}, {
+			name:              "old receive",
+			args:              args{stability: SemconvStabilityOld, op: operationReceive},
+			wantName:          "process queue",
+			wantOperationType: semconv126.MessagingOperationTypeReceive,
+			wantOperationName: "ack",
+			wantPublishAttrs:  true,
+		}, {
+			name:              "old nack",
+			args:              args{stability: SemconvStabilityOld, op: operationDeliver, settle: "nack"},
+			wantName:          "process queue",
+			wantOperationType: semconv126.MessagingOperationTypeDeliver,
+			wantOperationName: "nack",
+			wantPublishAttrs:  true,
+		}, {
+			name:              "new deliver",
+			args:              args{stability: SemconvStabilityNew, op: operationDeliver},
+			wantName:          "process queue",
+			wantOperationType: semconv.MessagingOperationTypeProcess,
+			wantOperationName: "process",
+			wantOutcome:       true,
+		}, {
+			name:              "new receive is modelled as process",
+			args:              args{stability: SemconvStabilityNew, op: operationReceive},
+			wantName:          "process queue",
+			wantOperationType: semconv.MessagingOperationTypeProcess,
+			wantOperationName: "process",
+			wantOutcome:       true,
+		}, {
+			name:              "new ack",
+			args:              args{stability: SemconvStabilityNew, op: operationDeliver, settle: "ack"},
+			wantName:          "process queue",
+			wantOperationType: semconv.MessagingOperationTypeProcess,
+			wantOperationName: "process",
+			wantOutcome:       true,
+		}, {
+			name:              "new nack",
+			args:              args{stability: SemconvStabilityNew, op: operationDeliver, settle: "nack"},
+			wantName:          "process queue",
+			wantOperationType: semconv.MessagingOperationTypeProcess,
+			wantOperationName: "process",
+			wantOutcome:       true,
+		}, {
+			name:              "dup deliver",
+			args:              args{stability: SemconvStabilityDup, op: operationDeliver},
+			wantName:          "process queue",
+			wantOperationType: semconv.MessagingOperationTypeProcess,
+			wantOperationName: "process",
+			wantOutcome:       true,
+			wantPublishAttrs:  true,
+		}, {
+			name:              "dup ack",
+			args:              args{stability: SemconvStabilityDup, op: operationDeliver, settle: "ack"},
+			wantName:          "process queue",
+			wantOperationType: semconv.MessagingOperationTypeProcess,
+			wantOperationName: "process",
+			wantOutcome:       true,
+			wantPublishAttrs:  true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp, exp := initMockTracerProvider()
+			ch := newTestChannel(t, WithTracerProvider(tp), WithSemconvStability(tt.args.stability))
+			acker := mockamqp091.NewMockAcknowledger(t)
+			msg := amqp091.Delivery{Acknowledger: acker, DeliveryTag: 1, Exchange: "exchange"}
+
+			ch.startConsumerSpan(&msg, "queue", tt.args.op, tt.args.settle == "")
+			wantOutcome := "ack"
+			switch tt.args.settle {
+			case "ack":
+				acker.EXPECT().Ack(uint64(1), false).Return(nil)
+				require.NoError(t, msg.Ack(false))
+			case "nack":
+				acker.EXPECT().Nack(uint64(1), false, true).Return(nil)
+				require.NoError(t, msg.Nack(false, true))
+				wantOutcome = "nack"
+			default:
+				EndDelivery(msg, nil)
+			}
+
+			spans := exp.GetSpans()
+			require.Len(t, spans, 1)
+			assert.Equal(t, tt.wantName, spans[0].Name)
+			assert.Contains(t, spans[0].Attributes, tt.wantOperationType)
+			assert.Contains(t, spans[0].Attributes, semconv.MessagingOperationName(tt.wantOperationName))
+			if tt.wantOutcome {
+				assert.Contains(t, spans[0].Attributes, settleOutcomeKey.String(wantOutcome))
+			} else {
+				assert.NotContains(t, spans[0].Attributes, settleOutcomeKey.String(wantOutcome))
+			}
+			publishName := semconv126.MessagingDestinationPublishName("exchange")
+			if tt.wantPublishAttrs {
+				assert.Contains(t, spans[0].Attributes, publishName)
+			} else {
+				assert.NotContains(t, spans[0].Attributes, publishName)
+			}
+		})
+	}
+}
+
+func TestSemconvStability_operationType_publish(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, semconv126.MessagingOperationTypePublish, SemconvStabilityOld.operationType(operationPublish))
+	assert.Equal(t, semconv.MessagingOperationTypeSend, SemconvStabilityNew.operationType(operationPublish))
+	assert.Equal(t, semconv.MessagingOperationTypeSend, SemconvStabilityDup.operationType(operationPublish))
+}
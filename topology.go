@@ -0,0 +1,185 @@
+package amqp091otel
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// Topology operations are traced only when [WithTopologySpans] is used,
+// otherwise the *WithContext methods below simply call their [amqp091.Channel] counterparts.
+
+// QueueDeclareWithContext is the traced version of [amqp091.Channel.QueueDeclare].
+func (ch *Channel) QueueDeclareWithContext(
+	ctx context.Context, name string, durable, autoDelete, exclusive, noWait bool, args amqp091.Table,
+) (amqp091.Queue, error) {
+	var queue amqp091.Queue
+	err := ch.traceTopology(ctx, "queue.declare", name, queueAttrs(name, args), func(span trace.Span) (err error) {
+		queue, err = ch.Channel.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+		if err == nil && name == "" {
+			span.SetAttributes(semconv.MessagingDestinationName(queue.Name))
+		}
+		return err
+	})
+	return queue, err
+}
+
+// QueueBindWithContext is the traced version of [amqp091.Channel.QueueBind].
+func (ch *Channel) QueueBindWithContext(
+	ctx context.Context, name, key, exchange string, noWait bool, args amqp091.Table,
+) error {
+	attrs := append(queueAttrs(name, args), bindingAttrs(key, exchange)...)
+	return ch.traceTopology(ctx, "queue.bind", name, attrs, func(trace.Span) error {
+		return ch.Channel.QueueBind(name, key, exchange, noWait, args)
+	})
+}
+
+// QueueUnbindWithContext is the traced version of [amqp091.Channel.QueueUnbind].
+func (ch *Channel) QueueUnbindWithContext(
+	ctx context.Context, name, key, exchange string, args amqp091.Table,
+) error {
+	attrs := append(queueAttrs(name, args), bindingAttrs(key, exchange)...)
+	return ch.traceTopology(ctx, "queue.unbind", name, attrs, func(trace.Span) error {
+		return ch.Channel.QueueUnbind(name, key, exchange, args)
+	})
+}
+
+// QueuePurgeWithContext is the traced version of [amqp091.Channel.QueuePurge].
+func (ch *Channel) QueuePurgeWithContext(ctx context.Context, name string, noWait bool) (int, error) {
+	var count int
+	err := ch.traceTopology(ctx, "queue.purge", name, queueAttrs(name, nil), func(span trace.Span) (err error) {
+		count, err = ch.Channel.QueuePurge(name, noWait)
+		span.SetAttributes(topologyMessageCountKey.Int(count))
+		return err
+	})
+	return count, err
+}
+
+// QueueDeleteWithContext is the traced version of [amqp091.Channel.QueueDelete].
+func (ch *Channel) QueueDeleteWithContext(
+	ctx context.Context, name string, ifUnused, ifEmpty, noWait bool,
+) (int, error) {
+	var count int
+	err := ch.traceTopology(ctx, "queue.delete", name, queueAttrs(name, nil), func(span trace.Span) (err error) {
+		count, err = ch.Channel.QueueDelete(name, ifUnused, ifEmpty, noWait)
+		span.SetAttributes(topologyMessageCountKey.Int(count))
+		return err
+	})
+	return count, err
+}
+
+// ExchangeDeclareWithContext is the traced version of [amqp091.Channel.ExchangeDeclare].
+func (ch *Channel) ExchangeDeclareWithContext(
+	ctx context.Context, name, kind string, durable, autoDelete, internal, noWait bool, args amqp091.Table,
+) error {
+	attrs := append(exchangeAttrs(name, args), topologyExchangeTypeKey.String(kind))
+	return ch.traceTopology(ctx, "exchange.declare", name, attrs, func(trace.Span) error {
+		return ch.Channel.ExchangeDeclare(name, kind, durable, autoDelete, internal, noWait, args)
+	})
+}
+
+// ExchangeDeleteWithContext is the traced version of [amqp091.Channel.ExchangeDelete].
+func (ch *Channel) ExchangeDeleteWithContext(ctx context.Context, name string, ifUnused, noWait bool) error {
+	return ch.traceTopology(ctx, "exchange.delete", name, exchangeAttrs(name, nil), func(trace.Span) error {
+		return ch.Channel.ExchangeDelete(name, ifUnused, noWait)
+	})
+}
+
+// ExchangeBindWithContext is the traced version of [amqp091.Channel.ExchangeBind].
+func (ch *Channel) ExchangeBindWithContext(
+	ctx context.Context, destination, key, source string, noWait bool, args amqp091.Table,
+) error {
+	attrs := append(exchangeAttrs(destination, args), bindingAttrs(key, source)...)
+	return ch.traceTopology(ctx, "exchange.bind", destination, attrs, func(trace.Span) error {
+		return ch.Channel.ExchangeBind(destination, key, source, noWait, args)
+	})
+}
+
+// ExchangeUnbindWithContext is the traced version of [amqp091.Channel.ExchangeUnbind].
+func (ch *Channel) ExchangeUnbindWithContext(
+	ctx context.Context, destination, key, source string, noWait bool, args amqp091.Table,
+) error {
+	attrs := append(exchangeAttrs(destination, args), bindingAttrs(key, source)...)
+	return ch.traceTopology(ctx, "exchange.unbind", destination, attrs, func(trace.Span) error {
+		return ch.Channel.ExchangeUnbind(destination, key, source, noWait, args)
+	})
+}
+
+func queueAttrs(name string, args amqp091.Table) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		semconv.MessagingDestinationAnonymous(name == "" || queueAnonymous(name)),
+		semconv.MessagingDestinationName(name),
+	}
+	return append(attrs, argumentAttrs(args)...)
+}
+
+func exchangeAttrs(name string, args amqp091.Table) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		semconv.MessagingDestinationAnonymous(name == ""),
+		semconv.MessagingDestinationName(name),
+	}
+	return append(attrs, argumentAttrs(args)...)
+}
+
+func bindingAttrs(key, source string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.MessagingRabbitMQDestinationRoutingKey(key),
+		topologySourceExchangeKey.String(source),
+	}
+}
+
+// argumentAttrs converts the optional arguments of a topology operation, e.g. x-queue-type, to attributes.
+func argumentAttrs(args amqp091.Table) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(args))
+	for key, val := range args {
+		if attr, ok := tableValueAttr(topologyArgumentKeyPrefix+attribute.Key(key), val); ok {
+			attrs = append(attrs, attr)
+		}
+	}
+	return attrs
+}
+
+// nameWhenTopology returns the span name of the topology operation on the queue or exchange name.
+// An empty queue name means a server-named queue, and an empty exchange name means the default exchange.
+func nameWhenTopology(operation, name string) string {
+	switch {
+	case strings.HasPrefix(operation, "queue.") && (name == "" || queueAnonymous(name)):
+		name = "(anonymous)"
+	case name == "":
+		name = "(default)"
+	}
+	return operation + " " + name
+}
+
+// traceTopology calls fn within a span of the topology operation on the queue or exchange name,
+// if topology operations are to be traced.
+func (ch *Channel) traceTopology(
+	ctx context.Context, operation, name string, attrs []attribute.KeyValue, fn func(span trace.Span) error,
+) error {
+	if !ch.cfg.TopologySpans {
+		return fn(trace.SpanFromContext(context.Background()))
+	}
+
+	attrs = append(attrs, semconv.MessagingOperationName(operation))
+	attrs = append(attrs, ch.commonAttrs()...)
+	opts := []trace.SpanStartOption{
+		trace.WithAttributes(attrs...),
+		trace.WithSpanKind(trace.SpanKindClient),
+	}
+	_, span := ch.cfg.Tracer.Start(ctx, nameWhenTopology(operation, name), opts...)
+	defer span.End()
+
+	err := fn(span)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(errorAttrs(err)...)
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package amqp091otel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestChannel_traceTopology(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		enabled bool
+		err     error
+	}
+	tests := []struct {
+		name         string
+		args         args
+		wantSpansLen int
+		wantSpanCode codes.Code
+	}{
+		{
+			name:         "disabled",
+			args:         args{enabled: false},
+			wantSpansLen: 0,
+		}, {
+			name:         "enabled",
+			args:         args{enabled: true},
+			wantSpansLen: 1,
+			wantSpanCode: codes.Unset,
+		}, {
+			name: "enabled, got error",
+			args: args{
+				enabled: true,
+				err:     &amqp091.Error{Code: amqp091.PreconditionFailed, Reason: "PRECONDITION_FAILED"},
+			},
+			wantSpansLen: 1,
+			wantSpanCode: codes.Error,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp, exp := initMockTracerProvider()
+			ch := newTestChannel(t, WithTracerProvider(tp), WithTopologySpans(tt.args.enabled))
+			attrs := queueAttrs("queue", amqp091.Table{"x-queue-type": "quorum"})
+
+			called := false
+			err := ch.traceTopology(context.Background(), "queue.declare", "queue", attrs, func(trace.Span) error {
+				called = true
+				return tt.args.err
+			})
+
+			assert.True(t, called)
+			assert.ErrorIs(t, err, tt.args.err)
+			spans := exp.GetSpans()
+			require.Len(t, spans, tt.wantSpansLen)
+			if tt.wantSpansLen == 0 {
+				return
+			}
+			assert.Equal(t, "queue.declare queue", spans[0].Name)
+			assert.Equal(t, trace.SpanKindClient, spans[0].SpanKind)
+			assert.Equal(t, tt.wantSpanCode, spans[0].Status.Code)
+			assert.Contains(t, spans[0].Attributes, attribute.String("messaging.rabbitmq.argument.x-queue-type", "quorum"))
+			assert.Contains(t, spans[0].Attributes, semconv.MessagingOperationName("queue.declare"))
+		})
+	}
+}
+
+func Test_nameWhenTopology(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		operation string
+		name      string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "queue",
+			args: args{operation: "queue.declare", name: "queue"},
+			want: "queue.declare queue",
+		}, {
+			name: "server-named queue",
+			args: args{operation: "queue.declare", name: ""},
+			want: "queue.declare (anonymous)",
+		}, {
+			name: "generated queue name",
+			args: args{operation: "queue.bind", name: "amq.gen-abc"},
+			want: "queue.bind (anonymous)",
+		}, {
+			name: "default exchange",
+			args: args{operation: "exchange.declare", name: ""},
+			want: "exchange.declare (default)",
+		}, {
+			name: "exchange",
+			args: args{operation: "exchange.delete", name: "exchange"},
+			want: "exchange.delete exchange",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.want, nameWhenTopology(tt.args.operation, tt.args.name))
+		})
+	}
+}
+
+func Test_argumentAttrs(t *testing.T) {
+	t.Parallel()
+	got := argumentAttrs(amqp091.Table{
+		"x-queue-type":   "quorum",
+		"x-max-length":   int32(10),
+		"x-single":       true,
+		"x-ignore-table": amqp091.Table{},
+	})
+	assert.ElementsMatch(t, []attribute.KeyValue{
+		attribute.String("messaging.rabbitmq.argument.x-queue-type", "quorum"),
+		attribute.Int64("messaging.rabbitmq.argument.x-max-length", 10),
+		attribute.Bool("messaging.rabbitmq.argument.x-single", true),
+	}, got)
+}